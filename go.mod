@@ -4,16 +4,20 @@ go 1.14
 
 require (
 	cloud.google.com/go/storage v1.8.0 // indirect
+	github.com/aws/aws-sdk-go v1.31.9
+	github.com/docker/cli v0.0.0-20191017083524-a8ff7f821017
 	github.com/google/go-cmp v0.5.2 // indirect
 	github.com/google/go-containerregistry v0.1.3
 	github.com/google/martian v2.1.1-0.20190517191504-25dcb96d9e51+incompatible // indirect
+	github.com/hashicorp/go-multierror v1.0.0
 	github.com/hashicorp/go-retryablehttp v0.6.6 // indirect
 	github.com/hashicorp/terraform v0.13.2
 	github.com/kr/pretty v0.2.0 // indirect
 	github.com/mitchellh/mapstructure v1.3.1 // indirect
 	github.com/stretchr/testify v1.6.1 // indirect
 	github.com/ulikunitz/xz v0.5.7 // indirect
-	golang.org/x/net v0.0.0-20200904194848-62affa334b73 // indirect
+	golang.org/x/net v0.0.0-20200904194848-62affa334b73
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	golang.org/x/sys v0.0.0-20200916084744-dbad9cb7cb7a // indirect
 	google.golang.org/api v0.25.0 // indirect
 	google.golang.org/grpc v1.32.0 // indirect
@@ -0,0 +1,157 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// acrHostPattern matches Azure Container Registry hosts across the public and sovereign clouds
+var acrHostPattern = regexp.MustCompile(`^[a-z0-9]+\.azurecr\.(?:io|cn|us)$`)
+
+const (
+	acrDefaultAuthorityHost = "https://login.microsoftonline.com"
+	acrDefaultScope         = "https://management.azure.com/.default"
+)
+
+// acrTokens exchanges AAD access tokens for a service principal for ACR refresh tokens, caching each refresh
+// token for as long as the AAD token it was exchanged for remains valid
+type acrTokens struct {
+	tenantID   string
+	aad        *clientcredentials.Config
+	httpClient *http.Client // used to request AAD tokens, nil for http.DefaultClient
+
+	mu     sync.Mutex
+	tokens map[string]acrToken // keyed by registry host
+}
+
+type acrToken struct {
+	refreshToken string
+	expiresAt    time.Time
+}
+
+func newACRTokens(tenantID, clientID, clientSecret, authorityHost, scope string) *acrTokens {
+	if authorityHost == "" {
+		authorityHost = acrDefaultAuthorityHost
+	}
+	if scope == "" {
+		scope = acrDefaultScope
+	}
+
+	return &acrTokens{
+		tenantID: tenantID,
+		aad: &clientcredentials.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			TokenURL:     strings.TrimSuffix(authorityHost, "/") + "/" + tenantID + "/oauth2/v2.0/token",
+			Scopes:       []string{scope},
+		},
+		tokens: map[string]acrToken{},
+	}
+}
+
+// authenticator returns an authenticator for the given registry, or false if it is not an ACR registry or no
+// service principal has been configured. The token exchange is made over the given transport, and abandoned
+// should ctx be cancelled
+func (a *acrTokens) authenticator(ctx context.Context, reg name.Registry, rt http.RoundTripper) (authn.Authenticator, bool) {
+	if a == nil || !acrHostPattern.MatchString(reg.Name()) {
+		return nil, false
+	}
+
+	return &acrAuthenticator{ctx: ctx, tokens: a, registry: reg, transport: rt}, true
+}
+
+func (a *acrTokens) get(ctx context.Context, reg name.Registry, rt http.RoundTripper) (acrToken, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if t, ok := a.tokens[reg.Name()]; ok && time.Now().Before(t.expiresAt) {
+		return t, nil
+	}
+
+	t, err := a.exchange(ctx, reg, rt)
+	if err != nil {
+		return acrToken{}, fmt.Errorf("unable to retrieve ACR refresh token for '%s': %w", reg.Name(), err)
+	}
+	a.tokens[reg.Name()] = t
+
+	return t, nil
+}
+
+// exchange trades an AAD access token for an ACR refresh token via the registry's /oauth2/exchange endpoint
+func (a *acrTokens) exchange(ctx context.Context, reg name.Registry, rt http.RoundTripper) (acrToken, error) {
+	if a.httpClient != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, a.httpClient)
+	}
+
+	aadToken, err := a.aad.Token(ctx)
+	if err != nil {
+		return acrToken{}, err
+	}
+
+	exchangeURL := url.URL{Scheme: reg.Scheme(), Host: reg.RegistryStr(), Path: "/oauth2/exchange"}
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {reg.RegistryStr()},
+		"tenant":       {a.tenantID},
+		"access_token": {aadToken.AccessToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, exchangeURL.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return acrToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := http.Client{Transport: rt}
+	resp, err := client.Do(req)
+	if err != nil {
+		return acrToken{}, err
+	}
+	defer resp.Body.Close()
+
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return acrToken{}, err
+	}
+
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return acrToken{}, err
+	}
+	if body.RefreshToken == "" {
+		return acrToken{}, fmt.Errorf("no refresh token returned from %s", exchangeURL.String())
+	}
+
+	return acrToken{refreshToken: body.RefreshToken, expiresAt: aadToken.Expiry}, nil
+}
+
+// acrAuthenticator hands the ACR refresh token to go-containerregistry as an identity token, which is then
+// exchanged at the registry's token endpoint for an access token scoped to each individual pull or push
+type acrAuthenticator struct {
+	ctx       context.Context
+	tokens    *acrTokens
+	registry  name.Registry
+	transport http.RoundTripper
+}
+
+func (a *acrAuthenticator) Authorization() (*authn.AuthConfig, error) {
+	t, err := a.tokens.get(a.ctx, a.registry, a.transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authn.AuthConfig{IdentityToken: t.refreshToken}, nil
+}
@@ -0,0 +1,90 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestACRAuthenticator(t *testing.T) {
+	aadCalls, exchangeCalls := 0, 0
+	standIn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/my-tenant/oauth2/v2.0/token": // AAD
+			aadCalls++
+			if r.PostForm.Get("scope") != "https://management.chinacloudapi.cn/.default" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token":"aad-token","token_type":"Bearer","expires_in":3600}`)
+		case "/oauth2/exchange": // ACR
+			exchangeCalls++
+			if r.PostForm.Get("grant_type") != "access_token" || r.PostForm.Get("access_token") != "aad-token" ||
+				r.PostForm.Get("tenant") != "my-tenant" || r.PostForm.Get("service") != r.Host {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"refresh_token":"acr-refresh-token"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer standIn.Close()
+
+	tokens := newACRTokens("my-tenant", "client", "secret", standIn.URL, "https://management.chinacloudapi.cn/.default")
+
+	if _, ok := tokens.authenticator(context.Background(), mustRegistry(t, "gcr.io"), nil); ok {
+		t.Fatal("expected gcr.io not to be treated as an ACR registry")
+	}
+	if _, ok := tokens.authenticator(context.Background(), mustRegistry(t, "myregistry.azurecr.io"), nil); !ok {
+		t.Fatal("expected ACR registry to be detected")
+	}
+
+	auth := &acrAuthenticator{ctx: context.Background(), tokens: tokens, registry: mustRegistry(t, standIn.URL[7:])}
+	for i := 0; i < 2; i++ {
+		cfg, err := auth.Authorization()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.IdentityToken != "acr-refresh-token" {
+			t.Fatalf("unexpected identity token '%s'", cfg.IdentityToken)
+		}
+	}
+
+	if aadCalls != 1 || exchangeCalls != 1 {
+		t.Fatalf("expected refresh token to be cached, got %d AAD and %d exchange calls", aadCalls, exchangeCalls)
+	}
+
+	// Cancelling the context abandons the exchange
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := &acrAuthenticator{ctx: ctx, tokens: newACRTokens("my-tenant", "client", "secret", standIn.URL, ""), registry: mustRegistry(t, standIn.URL[7:])}
+	if _, err := cancelled.Authorization(); err == nil {
+		t.Fatal("expected the exchange to fail once the context is cancelled")
+	}
+	if aadCalls != 1 || exchangeCalls != 1 {
+		t.Fatalf("expected no calls once the context is cancelled, got %d AAD and %d exchange calls", aadCalls, exchangeCalls)
+	}
+
+	// Sovereign clouds take their own scope, otherwise the public cloud's is requested
+	if _, ok := tokens.authenticator(context.Background(), mustRegistry(t, "myregistry.azurecr.cn"), nil); !ok {
+		t.Fatal("expected sovereign cloud ACR registry to be detected")
+	}
+	if scopes := newACRTokens("my-tenant", "client", "secret", "", "").aad.Scopes; len(scopes) != 1 || scopes[0] != acrDefaultScope {
+		t.Fatalf("expected the default scope to be requested, got %v", scopes)
+	}
+
+	var nilTokens *acrTokens
+	if _, ok := nilTokens.authenticator(context.Background(), mustRegistry(t, "myregistry.azurecr.io"), nil); ok {
+		t.Fatal("expected no authenticator without a configured service principal")
+	}
+}
@@ -0,0 +1,91 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// authOption resolves the credentials used for every request against the registry of the given ref. A non-nil
+// override (from a resource level source_auth/destination_auth block) always wins. Otherwise, explicit
+// registry_auth blocks take precedence over the Docker config, which in turn takes precedence over any
+// registry specific defaults
+func (c *config) authOption(ref name.Reference, override authn.Authenticator) (remote.Option, error) {
+	if override != nil {
+		return remote.WithAuth(override), nil
+	}
+
+	reg := ref.Context().Registry
+
+	if auth, ok := c.registryAuth[reg.Name()]; ok {
+		return remote.WithAuth(auth), nil
+	}
+
+	if c.keychain != nil {
+		auth, err := c.keychain.Resolve(reg)
+		if err != nil {
+			return nil, err
+		}
+		if auth != authn.Anonymous {
+			return remote.WithAuth(auth), nil
+		}
+	}
+
+	if ecrAuth, ok := c.ecr.authenticator(c.ctx, reg); ok {
+		return remote.WithAuth(ecrAuth), nil
+	}
+
+	if acrAuth, ok := c.acr.authenticator(c.ctx, reg, c.connection(reg).transport); ok {
+		return remote.WithAuth(acrAuth), nil
+	}
+
+	googleAuth, ok, err := c.google.authenticator(reg)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return remote.WithAuth(googleAuth), nil
+	}
+
+	return remote.WithAuth(authn.Anonymous), nil
+}
+
+// resourceAuth returns the credentials from the given source_auth/destination_auth block of a resource, or nil
+// if the block is absent
+func resourceAuth(d interface{ Get(string) interface{} }, key string) (authn.Authenticator, error) {
+	raw := d.Get(key).([]interface{})
+	if len(raw) == 0 || raw[0] == nil {
+		return nil, nil
+	}
+
+	auth, err := staticAuthenticator(raw[0].(map[string]interface{}))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	return auth, nil
+}
+
+// staticAuthenticator builds an authenticator from a registry_auth block, which must specify either a
+// username/password pair or a bearer token, but not both
+func staticAuthenticator(ra map[string]interface{}) (authn.Authenticator, error) {
+	username, _ := ra["username"].(string)
+	password, _ := ra["password"].(string)
+	token, _ := ra["token"].(string)
+
+	switch {
+	case token != "" && (username != "" || password != ""):
+		return nil, errors.New("specify either 'token' or 'username' and 'password', not both")
+	case token != "":
+		return &authn.Bearer{Token: token}, nil
+	case username != "" && password != "":
+		return &authn.Basic{Username: username, Password: password}, nil
+	case username != "" || password != "":
+		return nil, errors.New("'username' and 'password' must be specified together")
+	default:
+		return nil, errors.New("one of 'token' or 'username' and 'password' must be specified")
+	}
+}
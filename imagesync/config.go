@@ -0,0 +1,248 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// config is the provider meta shared by every imagesync resource
+type config struct {
+	// ctx is passed to every remote call. For the provider meta this is cancelled when Terraform is interrupted;
+	// resource operations derive their own, subject to the resource's timeouts, with withContext
+	ctx context.Context
+
+	// registryAuth holds explicitly configured credentials, keyed by registry host
+	registryAuth map[string]authn.Authenticator
+
+	// keychain resolves credentials from a Docker config.json, nil unless 'use_docker_config' is set
+	keychain authn.Keychain
+
+	// ecr exchanges AWS credentials for tokens against any *.dkr.ecr.*.amazonaws.com registry
+	ecr *ecrTokens
+
+	// google authenticates against every Google hosted registry (gcr.io, *-docker.pkg.dev, etc.)
+	google *googleAuth
+
+	// acr exchanges a service principal's AAD tokens for refresh tokens against any *.azurecr.{io,cn,us} registry,
+	// nil if no service principal is configured
+	acr *acrTokens
+
+	// defaultConnection is used for every registry without a registry_connection block of its own
+	defaultConnection *registryConnection
+
+	// registryConnections holds per registry connectivity settings, keyed by registry host
+	registryConnections map[string]*registryConnection
+
+	// retry retries transient registry errors, both for individual requests and for whole image writes
+	retry *retryPolicy
+
+	// uploads tracks in progress blob uploads, so they can be cancelled at the registry if they're abandoned
+	uploads *uploadSessions
+
+	// transferLimits applies to every blob upload; the provider level limits, shared by every resource, followed
+	// by any resource level limits
+	transferLimits []*transferLimits
+}
+
+func providerConfigure(d *schema.ResourceData, stopCtx context.Context) (interface{}, error) {
+	c := &config{
+		ctx:                 stopCtx,
+		uploads:             newUploadSessions(),
+		registryAuth:        map[string]authn.Authenticator{},
+		registryConnections: map[string]*registryConnection{},
+	}
+
+	var httpSettings map[string]interface{}
+	if raw := d.Get("http").([]interface{}); len(raw) == 1 && raw[0] != nil {
+		httpSettings = raw[0].(map[string]interface{})
+	}
+	base, err := newBaseTransport(httpSettings)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http settings: %w", err)
+	}
+
+	var retrySettings map[string]interface{}
+	if raw := d.Get("retry").([]interface{}); len(raw) == 1 && raw[0] != nil {
+		retrySettings = raw[0].(map[string]interface{})
+	}
+	if c.retry, err = newRetryPolicy(retrySettings); err != nil {
+		return nil, fmt.Errorf("invalid retry settings: %w", err)
+	}
+
+	for _, raw := range d.Get("registry_auth").(*schema.Set).List() {
+		ra := raw.(map[string]interface{})
+
+		reg, err := name.NewRegistry(ra["address"].(string), name.WeakValidation)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := c.registryAuth[reg.Name()]; exists {
+			return nil, fmt.Errorf("duplicate registry_auth block for '%s'", reg.Name())
+		}
+
+		auth, err := staticAuthenticator(ra)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry_auth for '%s': %w", reg.Name(), err)
+		}
+		c.registryAuth[reg.Name()] = auth
+	}
+
+	if path := d.Get("docker_config_path").(string); path != "" && !d.Get("use_docker_config").(bool) {
+		return nil, fmt.Errorf("'docker_config_path' requires 'use_docker_config' to be enabled")
+	}
+
+	if d.Get("use_docker_config").(bool) {
+		c.keychain = &dockerConfigKeychain{path: d.Get("docker_config_path").(string)}
+	}
+
+	var assumeRoleARN, ecrEndpoint string
+	if raw := d.Get("ecr").([]interface{}); len(raw) == 1 && raw[0] != nil {
+		ecrCfg := raw[0].(map[string]interface{})
+		assumeRoleARN = ecrCfg["assume_role_arn"].(string)
+		ecrEndpoint = ecrCfg["endpoint"].(string)
+	}
+	c.ecr = newECRTokens(assumeRoleARN, ecrEndpoint)
+	c.ecr.httpClient = &http.Client{Transport: base}
+
+	c.google = &googleAuth{}
+	if raw := d.Get("google").([]interface{}); len(raw) == 1 && raw[0] != nil {
+		googleCfg := raw[0].(map[string]interface{})
+		c.google.credentials = googleCfg["credentials"].(string)
+		c.google.useGcloud = googleCfg["use_gcloud"].(bool)
+	}
+
+	if raw := d.Get("acr").([]interface{}); len(raw) == 1 && raw[0] != nil {
+		acrCfg := raw[0].(map[string]interface{})
+		c.acr = newACRTokens(
+			acrCfg["tenant_id"].(string),
+			acrCfg["client_id"].(string),
+			acrCfg["client_secret"].(string),
+			acrCfg["authority_host"].(string),
+			acrCfg["scope"].(string),
+		)
+	} else if os.Getenv("AZURE_CLIENT_SECRET") != "" {
+		// Fallback to the same environment variables the Azure SDKs use for service principals
+		c.acr = newACRTokens(
+			os.Getenv("AZURE_TENANT_ID"),
+			os.Getenv("AZURE_CLIENT_ID"),
+			os.Getenv("AZURE_CLIENT_SECRET"),
+			os.Getenv("AZURE_AUTHORITY_HOST"),
+			"",
+		)
+	}
+	if c.acr != nil {
+		c.acr.httpClient = &http.Client{Transport: base}
+	}
+
+	conn, err := newRegistryConnection(base, map[string]interface{}{
+		"insecure_http":   d.Get("insecure_http"),
+		"skip_tls_verify": d.Get("skip_tls_verify"),
+		"ca_bundle_pem":   d.Get("ca_bundle_pem"),
+		"client_cert_pem": d.Get("client_cert_pem"),
+		"client_key_pem":  d.Get("client_key_pem"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn.transport = newRetryTransport(conn.transport, c.retry)
+	c.defaultConnection = conn
+
+	for _, raw := range d.Get("registry_connection").(*schema.Set).List() {
+		rc := raw.(map[string]interface{})
+
+		reg, err := name.NewRegistry(rc["address"].(string), name.WeakValidation)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := c.registryConnections[reg.Name()]; exists {
+			return nil, fmt.Errorf("duplicate registry_connection block for '%s'", reg.Name())
+		}
+
+		conn, err := newRegistryConnection(base, rc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry_connection for '%s': %w", reg.Name(), err)
+		}
+		conn.transport = newRetryTransport(conn.transport, c.retry)
+		c.registryConnections[reg.Name()] = conn
+	}
+
+	if l := newTransferLimits(map[string]interface{}{
+		"max_concurrent_uploads":      d.Get("max_concurrent_uploads"),
+		"max_upload_bytes_per_second": d.Get("max_upload_bytes_per_second"),
+	}); l != nil {
+		c.transferLimits = append(c.transferLimits, l)
+	}
+
+	return c, nil
+}
+
+// withContext returns a copy of the config for which every remote call is made with ctx
+func (c *config) withContext(ctx context.Context) *config {
+	cc := *c
+	cc.ctx = ctx
+
+	return &cc
+}
+
+// withTransferLimits returns a copy of the config for which every blob upload is also subject to l, in addition to
+// any existing limits
+func (c *config) withTransferLimits(l *transferLimits) *config {
+	if l == nil {
+		return c
+	}
+
+	cc := *c
+	cc.transferLimits = append(append([]*transferLimits{}, c.transferLimits...), l)
+
+	return &cc
+}
+
+// connection returns the connectivity settings for the given registry
+func (c *config) connection(reg name.Registry) *registryConnection {
+	if conn, ok := c.registryConnections[reg.Name()]; ok {
+		return conn
+	}
+
+	return c.defaultConnection
+}
+
+// parseReference parses the given image reference, allowing the registry to be reached over plain HTTP if it
+// has been configured to be
+func (c *config) parseReference(ref string) (name.Reference, error) {
+	r, err := name.ParseReference(ref, name.WeakValidation)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.connection(r.Context().Registry).insecureHTTP {
+		return r, nil
+	}
+
+	return name.ParseReference(ref, name.WeakValidation, name.Insecure)
+}
+
+// remoteOptions returns the options for every remote call made against the registry of the given ref. A non-nil
+// auth overrides any provider level credentials for that registry
+func (c *config) remoteOptions(ref name.Reference, auth authn.Authenticator) ([]remote.Option, error) {
+	authOpt, err := c.authOption(ref, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := limitTransport(c.connection(ref.Context().Registry).transport, c.transferLimits...)
+
+	return []remote.Option{
+		authOpt,
+		remote.WithTransport(c.uploads.transport(rt)),
+		remote.WithContext(c.ctx),
+	}, nil
+}
@@ -0,0 +1,44 @@
+package imagesync
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// resourceDestinations returns every destination the source is synced to; either the single 'destination', or
+// each of the 'destinations'
+func resourceDestinations(d interface{ Get(string) interface{} }) []string {
+	if dest := d.Get("destination").(string); dest != "" {
+		return []string{dest}
+	}
+
+	return sortedStrings(d.Get("destinations").(*schema.Set))
+}
+
+// forEachDestination calls fn for every destination in parallel. Every destination is attempted regardless of
+// whether others fail, with each failure reported against the destination it occurred for
+func forEachDestination(dests []string, fn func(dest string) error) error {
+	errs := make([]error, len(dests))
+
+	var wg sync.WaitGroup
+	for i, dest := range dests {
+		wg.Add(1)
+		go func(i int, dest string) {
+			defer wg.Done()
+			errs[i] = fn(dest)
+		}(i, dest)
+	}
+	wg.Wait()
+
+	var result *multierror.Error
+	for i, err := range errs {
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("destination '%s': %w", dests[i], err))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
@@ -0,0 +1,140 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ecrHostPattern matches private ECR registries, e.g. 123456789012.dkr.ecr.eu-west-1.amazonaws.com, capturing
+// the account ID and region
+var ecrHostPattern = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// ecrTokenExpiryWindow is how long before expiry a cached token is considered stale, so a token is never handed
+// out just before it expires mid-upload
+const ecrTokenExpiryWindow = 5 * time.Minute
+
+// ecrTokens exchanges AWS credentials, resolved via the standard credential chain, for ECR registry tokens,
+// caching each token until it expires
+type ecrTokens struct {
+	assumeRoleARN string
+	endpoint      string
+	httpClient    *http.Client // used for every AWS API call, nil for the SDK default
+
+	mu     sync.Mutex
+	tokens map[string]ecrToken // keyed by registry host
+}
+
+type ecrToken struct {
+	username  string
+	password  string
+	expiresAt time.Time
+}
+
+func newECRTokens(assumeRoleARN, endpoint string) *ecrTokens {
+	return &ecrTokens{
+		assumeRoleARN: assumeRoleARN,
+		endpoint:      endpoint,
+		tokens:        map[string]ecrToken{},
+	}
+}
+
+// authenticator returns an authenticator for the given registry, or false if it is not an ECR registry. The token
+// request is abandoned should ctx be cancelled
+func (e *ecrTokens) authenticator(ctx context.Context, reg name.Registry) (authn.Authenticator, bool) {
+	m := ecrHostPattern.FindStringSubmatch(reg.Name())
+	if m == nil {
+		return nil, false
+	}
+
+	return &ecrAuthenticator{ctx: ctx, tokens: e, host: reg.Name(), accountID: m[1], region: m[2]}, true
+}
+
+func (e *ecrTokens) get(ctx context.Context, host, accountID, region string) (ecrToken, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if t, ok := e.tokens[host]; ok && time.Now().Add(ecrTokenExpiryWindow).Before(t.expiresAt) {
+		return t, nil
+	}
+
+	t, err := e.fetch(ctx, accountID, region)
+	if err != nil {
+		return ecrToken{}, fmt.Errorf("unable to retrieve ECR authorization token for '%s': %w", host, err)
+	}
+	e.tokens[host] = t
+
+	return t, nil
+}
+
+func (e *ecrTokens) fetch(ctx context.Context, accountID, region string) (ecrToken, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{Region: aws.String(region), HTTPClient: e.httpClient},
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return ecrToken{}, err
+	}
+
+	cfg := &aws.Config{}
+	if e.endpoint != "" {
+		cfg.Endpoint = aws.String(e.endpoint)
+	}
+	if e.assumeRoleARN != "" {
+		cfg.Credentials = stscreds.NewCredentials(sess, e.assumeRoleARN)
+	}
+
+	out, err := ecr.New(sess, cfg).GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{
+		RegistryIds: []*string{aws.String(accountID)},
+	})
+	if err != nil {
+		return ecrToken{}, err
+	}
+	if len(out.AuthorizationData) == 0 {
+		return ecrToken{}, fmt.Errorf("no authorization data returned for account '%s'", accountID)
+	}
+
+	data := out.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(data.AuthorizationToken))
+	if err != nil {
+		return ecrToken{}, err
+	}
+
+	// Tokens decode to 'AWS:<password>'
+	creds := strings.SplitN(string(decoded), ":", 2)
+	if len(creds) != 2 {
+		return ecrToken{}, fmt.Errorf("malformed authorization token returned for account '%s'", accountID)
+	}
+
+	return ecrToken{username: creds[0], password: creds[1], expiresAt: aws.TimeValue(data.ExpiresAt)}, nil
+}
+
+// ecrAuthenticator defers the token exchange until the registry actually challenges for credentials
+type ecrAuthenticator struct {
+	ctx       context.Context
+	tokens    *ecrTokens
+	host      string
+	accountID string
+	region    string
+}
+
+func (a *ecrAuthenticator) Authorization() (*authn.AuthConfig, error) {
+	t, err := a.tokens.get(a.ctx, a.host, a.accountID, a.region)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authn.AuthConfig{Username: t.username, Password: t.password}, nil
+}
@@ -0,0 +1,102 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestECRAuthenticator(t *testing.T) {
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "",
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	// Stand-in for the ECR API, issuing a token that expires the given duration from now
+	calls, expiresIn := 0, time.Hour
+	ecrAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if !strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".GetAuthorizationToken") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		token := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("AWS:password-%d", calls)))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprintf(w, `{"authorizationData":[{"authorizationToken":"%s","expiresAt":%d}]}`, token, time.Now().Add(expiresIn).Unix())
+	}))
+	defer ecrAPI.Close()
+
+	tokens := newECRTokens("", ecrAPI.URL)
+
+	if _, ok := tokens.authenticator(context.Background(), mustRegistry(t, "gcr.io")); ok {
+		t.Fatal("expected gcr.io not to be treated as an ECR registry")
+	}
+
+	auth, ok := tokens.authenticator(context.Background(), mustRegistry(t, "123456789012.dkr.ecr.eu-west-1.amazonaws.com"))
+	if !ok {
+		t.Fatal("expected ECR registry to be detected")
+	}
+
+	cfg, err := auth.Authorization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Username != "AWS" || cfg.Password != "password-1" {
+		t.Fatalf("unexpected credentials %s:%s", cfg.Username, cfg.Password)
+	}
+
+	// Cached tokens are reused until they near expiry
+	if _, err := auth.Authorization(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected cached token to be reused, got %d calls", calls)
+	}
+
+	// Tokens inside the expiry window are refreshed
+	expiresIn = time.Minute
+	tokens.tokens = map[string]ecrToken{}
+	if _, err := auth.Authorization(); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = auth.Authorization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || cfg.Password != "password-3" {
+		t.Fatalf("expected near-expiry token to be refreshed, got %d calls", calls)
+	}
+
+	// Cancelling the context abandons the token request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tokens.tokens = map[string]ecrToken{}
+	cancelled, _ := tokens.authenticator(ctx, mustRegistry(t, "123456789012.dkr.ecr.eu-west-1.amazonaws.com"))
+	if _, err := cancelled.Authorization(); err == nil {
+		t.Fatal("expected the token request to fail once the context is cancelled")
+	}
+	if calls != 3 {
+		t.Fatalf("expected no token request once the context is cancelled, got %d calls", calls)
+	}
+}
+
+func mustRegistry(t *testing.T, reg string) name.Registry {
+	r, err := name.NewRegistry(reg, name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
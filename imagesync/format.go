@@ -0,0 +1,263 @@
+package imagesync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// The manifest formats an image can be written to its destinations in
+const (
+	// manifestFormatPreserve writes the image with the same media types as the source
+	manifestFormatPreserve = "preserve"
+	// manifestFormatOCI writes the image with OCI media types
+	manifestFormatOCI = "oci"
+	// manifestFormatDocker writes the image with Docker v2 schema2 media types
+	manifestFormatDocker = "docker"
+)
+
+// mediaTypes holds the media types of every kind of manifest and blob, for a single manifest format
+type mediaTypes struct {
+	index, manifest, config types.MediaType
+	layers                  map[types.MediaType]types.MediaType // keyed by the equivalent media type of any format
+}
+
+var formatMediaTypes = map[string]mediaTypes{
+	manifestFormatOCI: {
+		index:    types.OCIImageIndex,
+		manifest: types.OCIManifestSchema1,
+		config:   types.OCIConfigJSON,
+		layers: map[types.MediaType]types.MediaType{
+			types.DockerLayer:                    types.OCILayer,
+			types.DockerUncompressedLayer:        types.OCIUncompressedLayer,
+			types.DockerForeignLayer:             types.OCIRestrictedLayer,
+			types.OCILayer:                       types.OCILayer,
+			types.OCIUncompressedLayer:           types.OCIUncompressedLayer,
+			types.OCIRestrictedLayer:             types.OCIRestrictedLayer,
+			types.OCIUncompressedRestrictedLayer: types.OCIUncompressedRestrictedLayer,
+		},
+	},
+	manifestFormatDocker: {
+		index:    types.DockerManifestList,
+		manifest: types.DockerManifestSchema2,
+		config:   types.DockerConfigJSON,
+		layers: map[types.MediaType]types.MediaType{
+			types.OCILayer:                types.DockerLayer,
+			types.OCIUncompressedLayer:    types.DockerUncompressedLayer,
+			types.OCIRestrictedLayer:      types.DockerForeignLayer,
+			types.DockerLayer:             types.DockerLayer,
+			types.DockerUncompressedLayer: types.DockerUncompressedLayer,
+			types.DockerForeignLayer:      types.DockerForeignLayer,
+		},
+	},
+}
+
+// formatArtifact rewrites the media types of a, along with every image within it, to those of the given manifest
+// format. Only manifests are rewritten; config and layer contents are the same in either format, so every blob is
+// written exactly as it is held by the source. With manifestFormatPreserve, a is returned as-is
+func formatArtifact(a artifact, format string) (artifact, error) {
+	mts, ok := formatMediaTypes[format]
+	if !ok {
+		return a, nil
+	}
+
+	switch a := a.(type) {
+	case v1.ImageIndex:
+		return formatIndex(a, mts)
+	case v1.Image:
+		return formatImage(a, mts)
+	default:
+		return nil, fmt.Errorf("unable to format artifact of type %T", a)
+	}
+}
+
+// formattedImage is an image with its manifest rewritten to use different media types
+type formattedImage struct {
+	v1.Image
+	manifest    *v1.Manifest
+	rawManifest []byte
+	mediaType   types.MediaType
+}
+
+func formatImage(img v1.Image, mts mediaTypes) (v1.Image, error) {
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	// Images already in the requested format are left untouched, so their digest is left untouched too
+	formatted := mt == mts.manifest && m.Config.MediaType == mts.config
+	for _, l := range m.Layers {
+		formatted = formatted && mts.layers[l.MediaType] == l.MediaType
+	}
+	if formatted {
+		return img, nil
+	}
+
+	m = m.DeepCopy()
+	m.Config.MediaType = mts.config
+	for i, l := range m.Layers {
+		mt, ok := mts.layers[l.MediaType]
+		if !ok {
+			return nil, fmt.Errorf("unable to convert layer %s with media type %s to %s", l.Digest, l.MediaType, mts.manifest)
+		}
+		m.Layers[i].MediaType = mt
+	}
+
+	// mediaType is left unset in OCI manifests, as mutate.MediaType does
+	m.MediaType = mts.manifest
+	if mts.manifest == types.OCIManifestSchema1 {
+		m.MediaType = ""
+	}
+
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return &formattedImage{Image: img, manifest: m, rawManifest: raw, mediaType: mts.manifest}, nil
+}
+
+func (i *formattedImage) MediaType() (types.MediaType, error) {
+	return i.mediaType, nil
+}
+
+func (i *formattedImage) Manifest() (*v1.Manifest, error) {
+	return i.manifest.DeepCopy(), nil
+}
+
+func (i *formattedImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *formattedImage) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+func (i *formattedImage) Size() (int64, error) {
+	return partial.Size(i)
+}
+
+// formattedIndex is an index with its manifest, and that of every child, rewritten to use different media types
+type formattedIndex struct {
+	manifest    *v1.IndexManifest
+	rawManifest []byte
+	mediaType   types.MediaType
+	children    map[v1.Hash]artifact // keyed by the digest of the formatted child
+}
+
+func formatIndex(idx v1.ImageIndex, mts mediaTypes) (v1.ImageIndex, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	mt, err := idx.MediaType()
+	if err != nil {
+		return nil, err
+	}
+
+	formatted := mt == mts.index
+	im = im.DeepCopy()
+	children := map[v1.Hash]artifact{}
+	for i, child := range im.Manifests {
+		var formattedChild artifact
+		switch child.MediaType {
+		case types.OCIImageIndex, types.DockerManifestList:
+			childIdx, err := idx.ImageIndex(child.Digest)
+			if err != nil {
+				return nil, err
+			}
+			formattedChild, err = formatIndex(childIdx, mts)
+			if err != nil {
+				return nil, err
+			}
+		case types.OCIManifestSchema1, types.DockerManifestSchema2:
+			childImg, err := idx.Image(child.Digest)
+			if err != nil {
+				return nil, err
+			}
+			formattedChild, err = formatImage(childImg, mts)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unable to convert child %s with media type %s to %s", child.Digest, child.MediaType, mts.index)
+		}
+
+		raw, err := formattedChild.RawManifest()
+		if err != nil {
+			return nil, err
+		}
+		h, size, err := v1.SHA256(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+
+		im.Manifests[i].Digest = h
+		im.Manifests[i].Size = size
+		if isIndex(child.MediaType) {
+			im.Manifests[i].MediaType = mts.index
+		} else {
+			im.Manifests[i].MediaType = mts.manifest
+		}
+		children[h] = formattedChild
+		formatted = formatted && h == child.Digest
+	}
+	if formatted {
+		return idx, nil
+	}
+
+	im.MediaType = mts.index
+	raw, err := json.Marshal(im)
+	if err != nil {
+		return nil, err
+	}
+
+	return &formattedIndex{manifest: im, rawManifest: raw, mediaType: mts.index, children: children}, nil
+}
+
+func (i *formattedIndex) MediaType() (types.MediaType, error) {
+	return i.mediaType, nil
+}
+
+func (i *formattedIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return i.manifest.DeepCopy(), nil
+}
+
+func (i *formattedIndex) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *formattedIndex) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+func (i *formattedIndex) Size() (int64, error) {
+	return partial.Size(i)
+}
+
+func (i *formattedIndex) Image(h v1.Hash) (v1.Image, error) {
+	img, ok := i.children[h].(v1.Image)
+	if !ok {
+		return nil, fmt.Errorf("no image with digest %s in the index", h)
+	}
+	return img, nil
+}
+
+func (i *formattedIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	idx, ok := i.children[h].(v1.ImageIndex)
+	if !ok {
+		return nil, fmt.Errorf("no index with digest %s in the index", h)
+	}
+	return idx, nil
+}
@@ -0,0 +1,63 @@
+package imagesync
+
+import (
+	"log"
+	"regexp"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// googleHostPattern matches every Google hosted registry domain; Container Registry (gcr.io, eu.gcr.io,
+// mirror.gcr.io, etc.) and Artifact Registry (e.g. europe-west1-docker.pkg.dev)
+var googleHostPattern = regexp.MustCompile(`^(?:(?:[a-z0-9-]+\.)?gcr\.io|[a-z0-9-]+-docker\.pkg\.dev)$`)
+
+// googleAuth lazily resolves a single authenticator shared by every Google hosted registry. A service account
+// key takes precedence over application default credentials, which in turn take precedence over gcloud (if
+// the fallback is enabled). Without any of these, requests are made anonymously
+type googleAuth struct {
+	credentials string
+	useGcloud   bool
+
+	once sync.Once
+	auth authn.Authenticator
+	err  error
+}
+
+// authenticator returns the authenticator for the given registry, or false if it is not hosted by Google
+func (g *googleAuth) authenticator(reg name.Registry) (authn.Authenticator, bool, error) {
+	if !googleHostPattern.MatchString(reg.Name()) {
+		return nil, false, nil
+	}
+
+	g.once.Do(func() {
+		g.auth, g.err = g.resolve()
+	})
+
+	return g.auth, true, g.err
+}
+
+func (g *googleAuth) resolve() (authn.Authenticator, error) {
+	if g.credentials != "" {
+		return google.NewJSONKeyAuthenticator(g.credentials), nil
+	}
+
+	envAuth, err := google.NewEnvAuthenticator()
+	if err == nil {
+		return envAuth, nil
+	}
+
+	if g.useGcloud {
+		gcloudAuth, gcloudErr := google.NewGcloudAuthenticator()
+		if gcloudErr == nil {
+			return gcloudAuth, nil
+		}
+		err = gcloudErr
+	}
+
+	// Public registries (e.g. mirror.gcr.io) can still be pulled from without any credentials
+	log.Printf("[DEBUG] no Google credentials found, falling back to anonymous access: %s", err)
+	return authn.Anonymous, nil
+}
@@ -0,0 +1,61 @@
+package imagesync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+func TestGoogleAuthenticator(t *testing.T) {
+	g := &googleAuth{credentials: `{"type": "service_account"}`}
+
+	for reg, google := range map[string]bool{
+		"gcr.io":                         true,
+		"eu.gcr.io":                      true,
+		"mirror.gcr.io":                  true,
+		"europe-west1-docker.pkg.dev":    true,
+		"us-docker.pkg.dev":              true,
+		"europe-west1-npm.pkg.dev":       false,
+		"gcr.io.example.com":             false,
+		"notgcr.io":                      false,
+		"registry.hub.docker.com":        false,
+		"123456789012.dkr.ecr.us-east-1": false,
+	} {
+		auth, ok, err := g.authenticator(mustRegistry(t, reg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != google {
+			t.Errorf("expected '%s' google hosted to be %t", reg, google)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		cfg, err := auth.Authorization()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Username != "_json_key" || cfg.Password != g.credentials {
+			t.Errorf("expected '%s' to authenticate with the service account key", reg)
+		}
+	}
+}
+
+func TestGoogleAuthenticatorAnonymous(t *testing.T) {
+	// Application default credentials that can't be found, as when none have been configured
+	defer os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(t.TempDir(), "missing.json"))
+
+	g := &googleAuth{}
+	auth, ok, err := g.authenticator(mustRegistry(t, "mirror.gcr.io"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || auth != authn.Anonymous {
+		t.Errorf("expected anonymous access to 'mirror.gcr.io' without any credentials, got %v", auth)
+	}
+}
@@ -1,42 +1,183 @@
 package imagesync
 
 import (
+	"errors"
+	"fmt"
+	neturl "net/url"
 	"regexp"
 	"strings"
 
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
-func getRemoteImage(url string) (v1.Image, bool, error) {
-	urlRef, err := name.ParseReference(url, name.WeakValidation)
+// getRemoteDescriptor fetches the manifest at the given url, which may describe either a single image or an
+// index of images (e.g. a multi-arch manifest list). If no manifest exists at the url, false is returned
+func getRemoteDescriptor(url string, c *config, auth authn.Authenticator) (*remote.Descriptor, bool, error) {
+	urlRef, err := c.parseReference(url)
 	if err != nil {
-		return empty.Image, false, err
+		return nil, false, err
 	}
 
-	ao, err := authOption(urlRef)
+	opts, err := c.remoteOptions(urlRef, auth)
 	if err != nil {
-		return empty.Image, false, err
+		return nil, false, err
 	}
 
-	i, err := remote.Image(urlRef, ao)
+	desc, err := remote.Get(urlRef, opts...)
 	if err != nil {
-		if tErr, ok := (err).(*transport.Error); ok && tErr.StatusCode == 404 {
-			return empty.Image, false, nil
+		if isNotFound(err) {
+			return nil, false, nil
 		}
-		return empty.Image, false, err
+		return nil, false, err
 	}
 
-	return i, true, nil
+	return desc, true, nil
+}
+
+// getRemoteDigest resolves the digest (and media type) of the manifest at the given url, without fetching the
+// manifest itself. If no manifest exists at the url, false is returned
+func getRemoteDigest(url string, c *config, auth authn.Authenticator) (*v1.Descriptor, bool, error) {
+	urlRef, err := c.parseReference(url)
+	if err != nil {
+		return nil, false, err
+	}
+
+	opts, err := c.remoteOptions(urlRef, auth)
+	if err != nil {
+		return nil, false, err
+	}
+
+	desc, err := headDescriptor(urlRef, opts...)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return desc, true, nil
+}
+
+// headDescriptor resolves the descriptor of the manifest at ref with a HEAD request, which (unlike fetching the
+// manifest) registries such as Docker Hub don't count towards pull rate limits. Registries that don't describe the
+// manifest in the response (i.e. without a Docker-Content-Digest header) have the manifest fetched instead
+func headDescriptor(ref name.Reference, options ...remote.Option) (*v1.Descriptor, error) {
+	desc, err := remote.Head(ref, options...)
+	if err == nil {
+		return desc, nil
+	}
+
+	// Failing to reach the registry, or the registry responding with an error, won't be any different with a GET.
+	// Anything else is a response that couldn't be made sense of
+	var tErr *transport.Error
+	var uErr *neturl.Error
+	if errors.As(err, &tErr) || errors.As(err, &uErr) {
+		return nil, err
+	}
+
+	full, err := remote.Get(ref, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &full.Descriptor, nil
+}
+
+// isNotFound reports whether err is a registry's response to a manifest that doesn't exist
+func isNotFound(err error) bool {
+	tErr, ok := err.(*transport.Error)
+	return ok && tErr.StatusCode == 404
+}
+
+// artifact is anything that can be pushed to a destination; either a v1.Image or a v1.ImageIndex
+type artifact interface {
+	Digest() (v1.Hash, error)
+	RawManifest() ([]byte, error)
+}
+
+// resolveArtifact determines what should be pushed to the destination for the given source. Indexes are filtered
+// down to the given platforms (if any), everything else is pushed as-is
+func resolveArtifact(desc *remote.Descriptor, platforms []v1.Platform) (artifact, error) {
+	if !isIndex(desc.MediaType) {
+		return desc.Image()
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(platforms) == 0 {
+		return idx, nil
+	}
+
+	return filterIndex(idx, platforms)
+}
+
+// writeArtifact pushes the given image or index to ref. Indexes are copied in their entirety, including every
+// child manifest and their blobs. Images fetched from a registry expose their layers as remote.MountableLayers, so
+// when ref shares a registry with the image's own repository, each layer is mounted across from that repository by
+// the registry itself rather than pulled down and pushed back up. If the registry refuses the mount (e.g. the
+// destination credentials can't read the source repository), the layer is uploaded as usual
+func writeArtifact(ref name.Reference, a artifact, options ...remote.Option) error {
+	switch a := a.(type) {
+	case v1.ImageIndex:
+		// remote.WriteIndex writes each child without the options it was given (dropping the context), so the
+		// children are written here first, leaving remote.WriteIndex to find they already exist
+		if err := writeIndexChildren(ref, a, options...); err != nil {
+			return err
+		}
+		return remote.WriteIndex(ref, a, options...)
+	case v1.Image:
+		return remote.Write(ref, a, options...)
+	default:
+		return fmt.Errorf("unable to write artifact of type %T", a)
+	}
+}
+
+func writeIndexChildren(ref name.Reference, idx v1.ImageIndex, options ...remote.Option) error {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, child := range im.Manifests {
+		childRef := ref.Context().Digest(child.Digest.String())
+
+		var a artifact
+		switch child.MediaType {
+		case types.OCIImageIndex, types.DockerManifestList:
+			a, err = idx.ImageIndex(child.Digest)
+		case types.OCIManifestSchema1, types.DockerManifestSchema2:
+			a, err = idx.Image(child.Digest)
+		default:
+			continue // Left for remote.WriteIndex to skip, as it does anything else it doesn't understand
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := writeArtifact(childRef, a, options...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isIndex(mt types.MediaType) bool {
+	return mt == types.OCIImageIndex || mt == types.DockerManifestList
 }
 
 // imageID is the fully qualified URL to the image, with any tags replaced with the sha256 digest instead
-func imageID(url string, img v1.Image) (string, error) {
+func imageID(url string, digest v1.Hash) string {
 	if hasSHA, _ := regexp.MatchString("(.+)(@sha256:)([a-f0-9]{64})", url); hasSHA {
-		return url, nil
+		return url
 	}
 
 	// Trim any tags from the url
@@ -45,12 +186,7 @@ func imageID(url string, img v1.Image) (string, error) {
 		url = url[:trimTo]
 	}
 
-	digest, err := img.Digest()
-	if err != nil {
-		return "", err
-	}
-
-	return url + "@" + digest.String(), nil
+	return url + "@" + digest.String()
 }
 
 // digestFromReference strips all content preceding the digest for the given, fully qualified, reference. If
@@ -0,0 +1,70 @@
+package imagesync
+
+import (
+	"os"
+
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// dockerConfigKeychain resolves credentials from a Docker config.json, including any 'credHelpers' or
+// 'credsStore' credential helper binaries it references
+type dockerConfigKeychain struct {
+	// path to the config.json to read. When empty, the file is located the same way the docker cli would
+	// (honouring $DOCKER_CONFIG, falling back to ~/.docker/config.json)
+	path string
+}
+
+func (k *dockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	cf, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Dockerhub credentials are stored under a legacy key, see authn.DefaultAuthKey
+	key := target.RegistryStr()
+	if key == name.DefaultRegistry {
+		key = authn.DefaultAuthKey
+	}
+
+	cfg, err := cf.GetAuthConfig(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg == (types.AuthConfig{}) {
+		return authn.Anonymous, nil
+	}
+
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
+
+// load reads the config file on every call, so credentials refreshed by helpers or 'docker login' during a
+// long running apply are always picked up
+func (k *dockerConfigKeychain) load() (*configfile.ConfigFile, error) {
+	if k.path == "" {
+		return dockerconfig.Load(os.Getenv("DOCKER_CONFIG"))
+	}
+
+	f, err := os.Open(k.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cf := configfile.New(k.path)
+	if err := cf.LoadFromReader(f); err != nil {
+		return nil, err
+	}
+
+	return cf, nil
+}
@@ -0,0 +1,159 @@
+package imagesync
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transferLimits caps the number of concurrent blob uploads and the rate at which blob contents are uploaded. A
+// single transferLimits is shared by every transfer it applies to, so provider level limits hold across every
+// resource in a run
+type transferLimits struct {
+	uploads   chan struct{}     // semaphore, nil for unlimited uploads
+	bandwidth *bandwidthLimiter // nil for unlimited bandwidth
+}
+
+// newTransferLimits builds limits from a set of settings, as described by transferLimitsSchema. nil is returned if
+// no limits are set
+func newTransferLimits(settings map[string]interface{}) *transferLimits {
+	maxUploads, _ := settings["max_concurrent_uploads"].(int)
+	maxBytesPerSecond, _ := settings["max_upload_bytes_per_second"].(int)
+	if maxUploads <= 0 && maxBytesPerSecond <= 0 {
+		return nil
+	}
+
+	l := &transferLimits{}
+	if maxUploads > 0 {
+		l.uploads = make(chan struct{}, maxUploads)
+	}
+	if maxBytesPerSecond > 0 {
+		l.bandwidth = &bandwidthLimiter{bytesPerSecond: maxBytesPerSecond}
+	}
+
+	return l
+}
+
+// limitTransport wraps rt so that every blob upload made through it is subject to each of the given limits
+func limitTransport(rt http.RoundTripper, limits ...*transferLimits) http.RoundTripper {
+	var applied []*transferLimits
+	for _, l := range limits {
+		if l != nil {
+			applied = append(applied, l)
+		}
+	}
+
+	if len(applied) == 0 {
+		return rt
+	}
+
+	return &limitedTransport{next: rt, limits: applied}
+}
+
+type limitedTransport struct {
+	next   http.RoundTripper
+	limits []*transferLimits
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isBlobUpload(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	// Limits are always acquired in the same order, so concurrent uploads can never deadlock one another
+	for _, l := range t.limits {
+		if l.uploads == nil {
+			continue
+		}
+
+		select {
+		case l.uploads <- struct{}{}:
+			defer func(l *transferLimits) { <-l.uploads }(l)
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	r := req.Clone(req.Context())
+	body := req.Body
+	for _, l := range t.limits {
+		if l.bandwidth != nil {
+			body = &limitedReadCloser{ReadCloser: body, ctx: req.Context(), limiter: l.bandwidth}
+		}
+	}
+	r.Body = body
+
+	return t.next.RoundTrip(r)
+}
+
+// isBlobUpload reports whether req carries the contents of a blob
+func isBlobUpload(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return false
+	}
+
+	return (req.Method == http.MethodPatch || req.Method == http.MethodPut || req.Method == http.MethodPost) &&
+		strings.Contains(req.URL.Path, "/blobs/uploads/")
+}
+
+// bandwidthLimiter paces reads across every reader sharing it, such that no more than bytesPerSecond are read in
+// total each second
+type bandwidthLimiter struct {
+	bytesPerSecond int
+
+	mu   sync.Mutex
+	next time.Time // the earliest time the next read may happen
+}
+
+// maxReadSize bounds each individual read, so a single reader can't consume a large burst of the bandwidth
+const maxReadSize = 32 * 1024
+
+// wait blocks until n bytes may be read, or until ctx is cancelled
+func (b *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	delay := b.next.Sub(now)
+	b.next = b.next.Add(time.Duration(n) * time.Second / time.Duration(b.bytesPerSecond))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type limitedReadCloser struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *bandwidthLimiter
+}
+
+func (r *limitedReadCloser) Read(p []byte) (int, error) {
+	if len(p) > maxReadSize {
+		p = p[:maxReadSize]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,130 @@
+package imagesync
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransferLimitsConcurrentUploads(t *testing.T) {
+	var inFlight, maxInFlight int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+
+		io.Copy(ioutil.Discard, r.Body)
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	shared := newTransferLimits(map[string]interface{}{"max_concurrent_uploads": 2})
+	client := http.Client{Transport: limitTransport(http.DefaultTransport, shared)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, _ := http.NewRequest(http.MethodPatch, srv.URL+"/v2/busybox/blobs/uploads/123", strings.NewReader("layer"))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if maxInFlight != 2 {
+		t.Fatalf("expected at most 2 concurrent uploads, got %d", maxInFlight)
+	}
+}
+
+func TestTransferLimitsBandwidth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer srv.Close()
+
+	// 3 uploads of 16KiB each, sharing 96KiB/s, should take around half a second in total
+	shared := newTransferLimits(map[string]interface{}{"max_upload_bytes_per_second": 96 * 1024})
+	client := http.Client{Transport: limitTransport(http.DefaultTransport, shared)}
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			body := strings.NewReader(strings.Repeat("x", 16*1024))
+			req, _ := http.NewRequest(http.MethodPut, srv.URL+"/v2/busybox/blobs/uploads/123?digest=sha256:abc", body)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("expected uploads to be throttled, took %v", elapsed)
+	}
+
+	// Requests that aren't blob uploads are never throttled
+	start = time.Now()
+	resp, err := client.Get(srv.URL + "/v2/busybox/manifests/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("expected manifest requests not to be throttled, took %v", elapsed)
+	}
+}
+
+func TestTransferLimitsBandwidthCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer srv.Close()
+
+	// At 1KiB/s, this upload would take over a minute
+	shared := newTransferLimits(map[string]interface{}{"max_upload_bytes_per_second": 1024})
+	client := http.Client{Transport: limitTransport(http.DefaultTransport, shared)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	body := strings.NewReader(strings.Repeat("x", 64*1024))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPut, srv.URL+"/v2/busybox/blobs/uploads/123?digest=sha256:abc", body)
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the upload to fail once the context is cancelled")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the throttled upload to be abandoned once cancelled, took %v", elapsed)
+	}
+}
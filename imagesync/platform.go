@@ -0,0 +1,123 @@
+package imagesync
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// parsePlatform parses a platform of the form os/arch[/variant], e.g. linux/arm64/v8
+func parsePlatform(s string) (v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return v1.Platform{}, fmt.Errorf("platform '%s' must be of the form os/arch[/variant]", s)
+	}
+
+	for _, p := range parts {
+		if p == "" {
+			return v1.Platform{}, fmt.Errorf("platform '%s' must be of the form os/arch[/variant]", s)
+		}
+	}
+
+	p := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+
+	return p, nil
+}
+
+func validatePlatform(v interface{}, k string) ([]string, []error) {
+	if _, err := parsePlatform(v.(string)); err != nil {
+		return nil, []error{err}
+	}
+	return nil, nil
+}
+
+// filterIndex builds a new index from only those children of idx matching at least one of the given platforms.
+// Children without a platform (e.g. attestations) never match
+func filterIndex(idx v1.ImageIndex, platforms []v1.Platform) (v1.ImageIndex, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var adds []mutate.IndexAddendum
+	for _, child := range im.Manifests {
+		if child.Platform == nil || !matchesAnyPlatform(*child.Platform, platforms) {
+			continue
+		}
+
+		var add mutate.Appendable
+		if isIndex(child.MediaType) {
+			add, err = idx.ImageIndex(child.Digest)
+		} else {
+			add, err = idx.Image(child.Digest)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		adds = append(adds, mutate.IndexAddendum{Add: add, Descriptor: child})
+	}
+
+	if len(adds) == 0 {
+		return nil, fmt.Errorf("no images in the index match any of the requested platforms")
+	}
+
+	mt, err := idx.MediaType()
+	if err != nil {
+		return nil, err
+	}
+
+	return mutate.IndexMediaType(mutate.AppendManifests(empty.Index, adds...), mt), nil
+}
+
+func matchesAnyPlatform(given v1.Platform, platforms []v1.Platform) bool {
+	for _, required := range platforms {
+		if matchesPlatform(given, required) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesPlatform mirrors the (unexported) matching go-containerregistry applies when resolving an index to a
+// single platform with remote.WithPlatform:
+// - architecture and OS are identical.
+// - OS version and variant are identical if provided.
+// - features and OS features of the required platform are subsets of those of the given platform.
+func matchesPlatform(given, required v1.Platform) bool {
+	if given.Architecture != required.Architecture || given.OS != required.OS {
+		return false
+	}
+
+	if required.OSVersion != "" && given.OSVersion != required.OSVersion {
+		return false
+	}
+	if required.Variant != "" && given.Variant != required.Variant {
+		return false
+	}
+
+	return isSubset(given.OSFeatures, required.OSFeatures) && isSubset(given.Features, required.Features)
+}
+
+// isSubset checks if the required array of strings is a subset of the given lst
+func isSubset(lst, required []string) bool {
+	set := make(map[string]bool)
+	for _, value := range lst {
+		set[value] = true
+	}
+
+	for _, value := range required {
+		if !set[value] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,16 +1,311 @@
 package imagesync
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"github.com/hashicorp/terraform/terraform"
 )
 
 func Provider() terraform.ResourceProvider {
-	return &schema.Provider{
-		Schema:        map[string]*schema.Schema{},
-		ConfigureFunc: nil,
+	p := &schema.Provider{
+		Schema: providerSchema(),
 		ResourcesMap: map[string]*schema.Resource{
 			"imagesync": imagesync(),
 		},
 	}
+
+	p.ConfigureFunc = func(d *schema.ResourceData) (interface{}, error) {
+		return providerConfigure(d, p.StopContext())
+	}
+
+	return p
+}
+
+func providerSchema() map[string]*schema.Schema {
+	s := map[string]*schema.Schema{
+		"registry_auth": {
+			Type:     schema.TypeSet,
+			Optional: true,
+			Elem: &schema.Resource{
+				Schema: registryAuthSchema(),
+			},
+		},
+		"use_docker_config": {
+			Type:     schema.TypeBool,
+			Optional: true,
+			Default:  false,
+		},
+		"docker_config_path": {
+			Type:     schema.TypeString,
+			Optional: true,
+		},
+		"ecr": {
+			Type:     schema.TypeList,
+			Optional: true,
+			MaxItems: 1,
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"assume_role_arn": {
+						Type:     schema.TypeString,
+						Optional: true,
+					},
+					"endpoint": {
+						Type:     schema.TypeString,
+						Optional: true,
+					},
+				},
+			},
+		},
+		"google": {
+			Type:     schema.TypeList,
+			Optional: true,
+			MaxItems: 1,
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"credentials": {
+						Type:      schema.TypeString,
+						Optional:  true,
+						Sensitive: true,
+					},
+					"use_gcloud": {
+						Type:     schema.TypeBool,
+						Optional: true,
+						Default:  false,
+					},
+				},
+			},
+		},
+		"http": {
+			Type:     schema.TypeList,
+			Optional: true,
+			MaxItems: 1,
+			Elem: &schema.Resource{
+				Schema: httpSchema(),
+			},
+		},
+		"retry": {
+			Type:     schema.TypeList,
+			Optional: true,
+			MaxItems: 1,
+			Elem: &schema.Resource{
+				Schema: retrySchema(),
+			},
+		},
+		"registry_connection": {
+			Type:     schema.TypeSet,
+			Optional: true,
+			Elem: &schema.Resource{
+				Schema: registryConnectionSchema(),
+			},
+		},
+		"acr": {
+			Type:     schema.TypeList,
+			Optional: true,
+			MaxItems: 1,
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"tenant_id": {
+						Type:     schema.TypeString,
+						Required: true,
+					},
+					"client_id": {
+						Type:     schema.TypeString,
+						Required: true,
+					},
+					"client_secret": {
+						Type:      schema.TypeString,
+						Required:  true,
+						Sensitive: true,
+					},
+					"authority_host": {
+						Type:     schema.TypeString,
+						Optional: true,
+						Default:  acrDefaultAuthorityHost,
+					},
+					"scope": {
+						Type:     schema.TypeString,
+						Optional: true,
+						Default:  acrDefaultScope,
+					},
+				},
+			},
+		},
+	}
+
+	// Provider level connectivity settings apply to every registry without a registry_connection block
+	for k, v := range connectionSchema() {
+		s[k] = v
+	}
+
+	// Provider level transfer limits are shared by every imagesync resource
+	for k, v := range transferLimitsSchema() {
+		s[k] = v
+	}
+
+	return s
+}
+
+func registryAuthSchema() map[string]*schema.Schema {
+	s := credentialsSchema()
+	s["address"] = &schema.Schema{
+		Type:     schema.TypeString,
+		Required: true,
+	}
+	return s
+}
+
+// credentialsSchema is the set of static credentials accepted wherever a registry can be authenticated against
+func credentialsSchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"username": {
+			Type:     schema.TypeString,
+			Optional: true,
+		},
+		"password": {
+			Type:      schema.TypeString,
+			Optional:  true,
+			Sensitive: true,
+		},
+		"token": {
+			Type:      schema.TypeString,
+			Optional:  true,
+			Sensitive: true,
+		},
+	}
+}
+
+func registryConnectionSchema() map[string]*schema.Schema {
+	s := connectionSchema()
+	s["address"] = &schema.Schema{
+		Type:     schema.TypeString,
+		Required: true,
+	}
+	return s
+}
+
+// connectionSchema is the set of settings controlling how a registry is reached
+func connectionSchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"insecure_http": {
+			Type:     schema.TypeBool,
+			Optional: true,
+			Default:  false,
+		},
+		"skip_tls_verify": {
+			Type:     schema.TypeBool,
+			Optional: true,
+			Default:  false,
+		},
+		"ca_bundle_pem": {
+			Type:     schema.TypeString,
+			Optional: true,
+		},
+		"client_cert_pem": {
+			Type:     schema.TypeString,
+			Optional: true,
+		},
+		"client_key_pem": {
+			Type:      schema.TypeString,
+			Optional:  true,
+			Sensitive: true,
+		},
+	}
+}
+
+// retrySchema is the set of settings controlling how transient registry errors are retried. Unset settings use
+// the defaults of retryPolicy
+func retrySchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"max_attempts": {
+			Type:         schema.TypeInt,
+			Optional:     true,
+			ValidateFunc: validation.IntAtLeast(1),
+		},
+		"min_backoff": {
+			Type:         schema.TypeString,
+			Optional:     true,
+			ValidateFunc: validateDuration,
+		},
+		"max_backoff": {
+			Type:         schema.TypeString,
+			Optional:     true,
+			ValidateFunc: validateDuration,
+		},
+		"retryable_status_codes": {
+			Type:     schema.TypeList,
+			Optional: true,
+			Elem: &schema.Schema{
+				Type:         schema.TypeInt,
+				ValidateFunc: validation.IntBetween(100, 599),
+			},
+		},
+	}
+}
+
+// transferLimitsSchema is the set of limits applied to blob uploads, where 0 means unlimited
+func transferLimitsSchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"max_concurrent_uploads": {
+			Type:         schema.TypeInt,
+			Optional:     true,
+			ValidateFunc: validation.IntAtLeast(0),
+		},
+		"max_upload_bytes_per_second": {
+			Type:         schema.TypeInt,
+			Optional:     true,
+			ValidateFunc: validation.IntAtLeast(0),
+		},
+	}
+}
+
+// httpSchema is the set of settings applied to the transport underlying every registry connection
+func httpSchema() map[string]*schema.Schema {
+	s := map[string]*schema.Schema{
+		"proxy_url": {
+			Type:     schema.TypeString,
+			Optional: true,
+		},
+		"proxy_username": {
+			Type:     schema.TypeString,
+			Optional: true,
+		},
+		"proxy_password": {
+			Type:      schema.TypeString,
+			Optional:  true,
+			Sensitive: true,
+		},
+		"no_proxy": {
+			Type:     schema.TypeList,
+			Optional: true,
+			Elem:     &schema.Schema{Type: schema.TypeString},
+		},
+	}
+
+	for _, k := range []string{"max_idle_conns", "max_idle_conns_per_host", "max_conns_per_host"} {
+		s[k] = &schema.Schema{
+			Type:         schema.TypeInt,
+			Optional:     true,
+			ValidateFunc: validation.IntAtLeast(0),
+		}
+	}
+
+	for _, k := range []string{"dial_timeout", "tls_handshake_timeout", "response_header_timeout", "idle_conn_timeout"} {
+		s[k] = &schema.Schema{
+			Type:         schema.TypeString,
+			Optional:     true,
+			ValidateFunc: validateDuration,
+		}
+	}
+
+	return s
+}
+
+func validateDuration(v interface{}, k string) ([]string, []error) {
+	if _, err := time.ParseDuration(v.(string)); err != nil {
+		return nil, []error{fmt.Errorf("%q must be a duration, e.g. '30s': %w", k, err)}
+	}
+	return nil, nil
 }
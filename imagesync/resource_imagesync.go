@@ -1,25 +1,82 @@
 package imagesync
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net"
+	"log"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1/google"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/terraform/helper/customdiff"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// The ways in which a destination that no longer holds the image it should (e.g. after the destination tag is
+// overwritten outside of Terraform) can be handled
+const (
+	// destinationDriftResync syncs the image to every destination again
+	destinationDriftResync = "resync"
+	// destinationDriftError fails the plan
+	destinationDriftError = "error"
+	// destinationDriftIgnore adopts whatever each destination now holds
+	destinationDriftIgnore = "ignore"
+)
+
+// The ways in which a source that can no longer be found upstream can be handled, once its image has been sync'd
+const (
+	// sourceMissingFail fails the plan
+	sourceMissingFail = "fail"
+	// sourceMissingKeep leaves every destination as it is
+	sourceMissingKeep = "keep"
+	// sourceMissingWarn leaves every destination as it is, logging a warning
+	sourceMissingWarn = "warn"
+)
+
+// What is deleted from each destination when the resource is destroyed
+const (
+	// destroyDeleteManifest deletes every tag, then the manifest if no other tag refers to it
+	destroyDeleteManifest = "delete_manifest"
+	// destroyDeleteTag deletes every tag, leaving the manifest in place
+	destroyDeleteTag = "delete_tag"
+	// destroyRetain deletes nothing
+	destroyRetain = "retain"
+)
+
+// The ways in which the destination can be replaced when the source image changes
+const (
+	// replaceStrategyOverwrite overwrites the destination tag in place, then deletes the old manifest
+	replaceStrategyOverwrite = "overwrite"
+	// replaceStrategyOverwriteRetain overwrites the destination tag in place, leaving the old manifest behind
+	replaceStrategyOverwriteRetain = "overwrite_retain"
+	// replaceStrategyRecreate destroys the destination, then syncs the new image from scratch
+	replaceStrategyRecreate = "recreate"
 )
 
 func imagesync() *schema.Resource {
-	return &schema.Resource{
+	r := &schema.Resource{
 		Create: imagesyncCreate,
 		Update: imagesyncUpdate,
 		Read:   imagesyncRead,
 		Delete: imagesyncDelete,
 		Importer: &schema.ResourceImporter{
-			State: schema.ImportStatePassthrough,
+			State: imagesyncImport,
+		},
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(30 * time.Minute),
+			Update: schema.DefaultTimeout(30 * time.Minute),
+			Read:   schema.DefaultTimeout(5 * time.Minute),
+			Delete: schema.DefaultTimeout(10 * time.Minute),
 		},
 
 		SchemaVersion: 1,
@@ -30,190 +87,1315 @@ func imagesync() *schema.Resource {
 				Required: true,
 			},
 			"destination": {
-				Type:     schema.TypeString,
-				Required: true,
-				ForceNew: true,
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"destinations"},
+			},
+			"destinations": {
+				Type:          schema.TypeSet,
+				Optional:      true,
+				Elem:          &schema.Schema{Type: schema.TypeString},
+				ConflictsWith: []string{"destination"},
+			},
+			"retain_previous_destination": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"destination_digests": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			// Unlike 'destination_digests', which refreshing overwrites with whatever each destination holds now,
+			// this records the digest of the image last sync'd to each destination
+			"synced_digests": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
 			},
 			"source_digest": {
 				Type:     schema.TypeString,
 				Computed: true,
-				ForceNew: true,
+			},
+			"destination_digest": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"on_destroy": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  destroyDeleteManifest,
+				ValidateFunc: validation.StringInSlice([]string{
+					destroyDeleteManifest,
+					destroyDeleteTag,
+					destroyRetain,
+				}, false),
+			},
+			"on_destination_drift": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  destinationDriftResync,
+				ValidateFunc: validation.StringInSlice([]string{
+					destinationDriftResync,
+					destinationDriftError,
+					destinationDriftIgnore,
+				}, false),
+			},
+			"manifest_format": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  manifestFormatPreserve,
+				ValidateFunc: validation.StringInSlice([]string{
+					manifestFormatPreserve,
+					manifestFormatOCI,
+					manifestFormatDocker,
+				}, false),
+			},
+			"on_source_missing": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  sourceMissingFail,
+				ValidateFunc: validation.StringInSlice([]string{
+					sourceMissingFail,
+					sourceMissingKeep,
+					sourceMissingWarn,
+				}, false),
+			},
+			"source_available": {
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+			"verify_source_on_plan": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"convert_schema1": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"converted_digest": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"replace_strategy": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  replaceStrategyOverwrite,
+				ValidateFunc: validation.StringInSlice([]string{
+					replaceStrategyOverwrite,
+					replaceStrategyOverwriteRetain,
+					replaceStrategyRecreate,
+				}, false),
+			},
+			"additional_tags": {
+				Type:     schema.TypeSet,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validateTag,
+				},
+			},
+			"platforms": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validatePlatform,
+				},
+			},
+			"source_auth": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: credentialsSchema(),
+				},
+			},
+			"destination_auth": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: credentialsSchema(),
+				},
 			},
 		},
 
-		CustomizeDiff: sourceChangedDiffFunc,
+		CustomizeDiff: customdiff.All(
+			destinationsDiffFunc,
+			sourceChangedDiffFunc,
+			destinationChangedDiffFunc,
+		),
+	}
+
+	// Resource level transfer limits apply on top of any provider level limits
+	for k, v := range transferLimitsSchema() {
+		r.Schema[k] = v
 	}
+
+	return r
 }
 
 func imagesyncCreate(d *schema.ResourceData, m interface{}) error {
-	src := d.Get("source").(string)
-	srcImg, exists, err := getRemoteImage(src)
+	ctx, cancel := context.WithTimeout(m.(*config).ctx, d.Timeout(schema.TimeoutCreate))
+	defer cancel()
+
+	c := m.(*config).withContext(ctx).withTransferLimits(resourceTransferLimits(d))
+
+	srcArtifact, err := resolveSource(d, c)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return fmt.Errorf("unable to locate source image at '%s'", src)
-	}
 
-	dest := d.Get("destination").(string)
-	destRef, err := name.ParseReference(dest, name.WeakValidation)
+	destAuth, err := resourceAuth(d, "destination_auth")
 	if err != nil {
 		return err
 	}
 
-	destAuthOpt, err := authOption(destRef)
+	srcDigest, err := srcArtifact.Digest()
 	if err != nil {
 		return err
 	}
 
-	if err := remote.Write(destRef, srcImg, destAuthOpt); err != nil {
+	var (
+		mu     sync.Mutex
+		synced = map[string]interface{}{}
+	)
+
+	additionalTags := sortedStrings(d.Get("additional_tags").(*schema.Set))
+	err = forEachDestination(resourceDestinations(d), func(dest string) error {
+		if err := writeDestination(c, dest, srcArtifact, additionalTags, destAuth); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		synced[dest] = srcDigest.String()
+		mu.Unlock()
+		return nil
+	})
+	if setErr := d.Set("synced_digests", synced); setErr != nil {
+		return setErr
+	}
+	if err != nil {
+		if len(synced) == 0 {
+			return err
+		}
+
+		// The destinations that were sync'd are kept in state, so that they're cleaned up rather than left behind
+		if readErr := readDestinations(d, m, true); readErr != nil {
+			return readErr
+		}
 		return err
 	}
 
-	return imagesyncRead(d, m) // Resync the state to ensure the digest and ID of state match remote img
+	return readDestinations(d, m, false) // Resync the state to ensure the digest and ID of state match remote img
 }
 
 func imagesyncUpdate(d *schema.ResourceData, m interface{}) error {
-	// Updates can only be triggered by 'source' changes that *don't* change the 'source_digest', suggesting a
-	// new registry/tag, but not a new underlying image. No actual update is necessary.
-	return imagesyncRead(d, m)
+	// Updates are triggered by either:
+	// - a change to the 'source_digest', requiring every destination to be overwritten with the new image
+	// - a change to the 'destination_digest' (e.g. a new 'manifest_format'), requiring the same
+	// - a change to the 'destination' within the same registry, allowing the existing image to be moved
+	// - a change to 'destinations', requiring the image to be sync'd to or deleted from only those that changed
+	// - a change to 'additional_tags'
+	// - a 'source' change that *doesn't* change the 'source_digest', suggesting a new registry/tag, but not a new
+	// underlying image. No actual update is necessary.
+	ctx, cancel := context.WithTimeout(m.(*config).ctx, d.Timeout(schema.TimeoutUpdate))
+	defer cancel()
+
+	c := m.(*config).withContext(ctx)
+
+	var err error
+	switch {
+	case d.HasChange("destination"):
+		err = imagesyncMove(d, c)
+	case d.HasChange("destinations"):
+		err = imagesyncRedistribute(d, c)
+	case d.HasChange("source_digest"), d.HasChange("destination_digest"):
+		err = imagesyncResync(d, c)
+	case d.HasChange("additional_tags"):
+		err = imagesyncRetag(d, c)
+	}
+	if err != nil {
+		return err
+	}
+
+	return readDestinations(d, m, false)
 }
 
-func imagesyncRead(d *schema.ResourceData, meta interface{}) error {
-	dest := d.Get("destination").(string)
-	destImg, exists, err := getRemoteImage(dest)
+// imagesyncResync overwrites every destination with the new source image. Only once the new image is confirmed to
+// be in place is the old one cleaned up (depending on the 'replace_strategy' and 'on_destroy'), so the destination
+// tag always refers to a pullable image
+func imagesyncResync(d *schema.ResourceData, c *config) error {
+	c = c.withTransferLimits(resourceTransferLimits(d))
+
+	srcArtifact, err := resolveSource(d, c)
 	if err != nil {
 		return err
 	}
 
-	if !exists {
-		d.SetId("")
-	} else {
-		imgID, err := imageID(dest, destImg)
+	srcDigest, err := srcArtifact.Digest()
+	if err != nil {
+		return err
+	}
+
+	destAuth, err := resourceAuth(d, "destination_auth")
+	if err != nil {
+		return err
+	}
+
+	o, n := d.GetChange("additional_tags")
+	removedTags := sortedStrings(o.(*schema.Set).Difference(n.(*schema.Set)))
+	additionalTags := sortedStrings(n.(*schema.Set))
+
+	// Cleaning up the old image deletes its manifest, which only 'delete_manifest' permits
+	cleanup := d.Get("replace_strategy").(string) == replaceStrategyOverwrite &&
+		d.Get("on_destroy").(string) == destroyDeleteManifest
+	refreshed := d.Get("destination_digests").(map[string]interface{})
+	syncedDigests := d.Get("synced_digests").(map[string]interface{})
+
+	// Destinations that fail to be overwritten still hold the image last sync'd to them
+	var mu sync.Mutex
+	synced := map[string]interface{}{}
+	for _, dest := range resourceDestinations(d) {
+		if digest, ok := syncedDigests[dest]; ok {
+			synced[dest] = digest
+		}
+	}
+
+	err = forEachDestination(resourceDestinations(d), func(dest string) error {
+		if err := untagDestination(c, dest, removedTags, destAuth); err != nil {
+			return err
+		}
+
+		if err := writeDestination(c, dest, srcArtifact, additionalTags, destAuth); err != nil {
+			return err
+		}
+
+		destDesc, exists, err := getRemoteDigest(dest, c, destAuth)
+		if err != nil {
+			return err
+		}
+		if !exists || destDesc.Digest != srcDigest {
+			return fmt.Errorf("'%s' does not refer to the new image %s after being overwritten", dest, srcDigest)
+		}
+
+		mu.Lock()
+		synced[dest] = srcDigest.String()
+		mu.Unlock()
+
+		// Only an image this resource sync'd itself is cleaned up. A destination that drifted held an image pushed
+		// outside of Terraform when last refreshed, which isn't ours to delete
+		oldDigest, _ := syncedDigests[dest].(string)
+		if !cleanup || oldDigest == "" || oldDigest == srcDigest.String() || refreshed[dest] != oldDigest {
+			return nil
+		}
+
+		destRef, err := c.parseReference(dest)
+		if err != nil {
+			return err
+		}
+
+		destOpts, err := c.remoteOptions(destRef, destAuth)
 		if err != nil {
 			return err
 		}
-		d.SetId(imgID)
+
+		return deleteUnreferencedManifest(destRef.Context(), oldDigest, destOpts...)
+	})
+	if setErr := d.Set("synced_digests", synced); setErr != nil {
+		return setErr
 	}
 
-	return nil
+	return err
 }
 
-func imagesyncDelete(d *schema.ResourceData, m interface{}) error {
-	dest := d.Get("destination").(string)
-	destRef, err := name.ParseReference(dest, name.WeakValidation)
+// imagesyncMove moves the image from the previous 'destination' to the new one, within the same registry. Within the
+// same repository this only requires a new tag. Otherwise, the image is copied between repositories, with every
+// blob mounted from the previous repository rather than uploaded. The previous 'destination' is then deleted as
+// 'on_destroy' dictates, unless it's retained with 'retain_previous_destination'
+func imagesyncMove(d *schema.ResourceData, c *config) error {
+	c = c.withTransferLimits(resourceTransferLimits(d))
+
+	destAuth, err := resourceAuth(d, "destination_auth")
 	if err != nil {
 		return err
 	}
 
-	destAuthOpt, err := authOption(destRef)
+	o, n := d.GetChange("destination")
+	oldDest, newDest := o.(string), n.(string)
+
+	oldRef, err := c.parseReference(oldDest)
 	if err != nil {
 		return err
 	}
 
-	// Delete this tag. Perform this regardless of if other tags exist
-	if err := remote.Delete(destRef, destAuthOpt); err != nil {
+	newRef, err := c.parseReference(newDest)
+	if err != nil {
 		return err
 	}
 
-	// Check through all available tags to see if there are any more images referencing these blobs
-	tags, err := remote.List(destRef.Context(), destAuthOpt)
+	oldDesc, exists, err := getRemoteDescriptor(oldDest, c, destAuth)
 	if err != nil {
-		if strings.Contains(err.Error(), "METHOD_UNKNOWN") {
-			// If the registry doesn't support listing images, we can't be sure we can safely delete these blobs
-			return nil
-		}
 		return err
 	}
+	if !exists {
+		return fmt.Errorf("unable to locate image at '%s' to move to '%s'", oldDest, newDest)
+	}
 
-	for _, t := range tags {
-		imgRef, err := name.ParseReference(destRef.Context().String()+":"+t, name.WeakValidation)
-		if err != nil {
+	// The image at the previous 'destination' is the one the new 'destination' holds once moved
+	synced := map[string]interface{}{newDest: oldDesc.Digest.String()}
+
+	oldTags, newTags := d.GetChange("additional_tags")
+	onDestroy := d.Get("on_destroy").(string)
+	retain := d.Get("retain_previous_destination").(bool) || onDestroy == destroyRetain
+
+	if oldRef.Context().Name() == newRef.Context().Name() {
+		// Digest references need no tag; the manifest is already present within the repository
+		if tag, ok := newRef.(name.Tag); ok {
+			if err := tagDestination(c, newDest, oldDesc, []string{tag.TagStr()}, destAuth); err != nil {
+				return err
+			}
+		}
+
+		removed := sortedStrings(oldTags.(*schema.Set).Difference(newTags.(*schema.Set)))
+		if err := untagDestination(c, newDest, removed, destAuth); err != nil {
 			return err
 		}
 
-		i, err := remote.Image(imgRef, destAuthOpt)
-		if err != nil {
+		added := sortedStrings(newTags.(*schema.Set).Difference(oldTags.(*schema.Set)))
+		if err := tagDestination(c, newDest, oldDesc, added, destAuth); err != nil {
 			return err
 		}
 
-		imageID, err := i.Digest()
-		if err != nil {
+		if err := d.Set("synced_digests", synced); err != nil {
 			return err
 		}
 
-		if imageID.String() == digestFromReference(d.Id()) {
-			return nil // Another image is using the same layers as we are, do not delete these layers!
+		if _, ok := oldRef.(name.Tag); ok && !retain {
+			return untagDestination(c, oldDest, []string{oldRef.Identifier()}, destAuth)
 		}
+		return nil
 	}
 
-	// No other tag references these layers, we're free to delete
-	idRef, err := name.ParseReference(d.Id(), name.WeakValidation)
+	a, err := resolveArtifact(oldDesc, nil)
 	if err != nil {
 		return err
 	}
 
-	return remote.Delete(idRef, destAuthOpt)
+	if err := writeDestination(c, newDest, a, sortedStrings(newTags.(*schema.Set)), destAuth); err != nil {
+		return err
+	}
+
+	if err := d.Set("synced_digests", synced); err != nil {
+		return err
+	}
+
+	if retain {
+		return nil
+	}
+
+	return deleteDestination(c, oldDest, oldDesc.Digest.String(), sortedStrings(oldTags.(*schema.Set)), onDestroy == destroyDeleteManifest, destAuth)
 }
 
-func sourceChangedDiffFunc(d *schema.ResourceDiff, v interface{}) error {
-	// Several things could have changed with the 'source', it could be that:
-	// - the user wants to use a different image
-	// - the source image in the registry has changed
-	// - the user wants the same image, but from a different registry
-	// If the first 2 are true, the digest will change, and so 'ForceNew' will be triggered,
-	// If the image digest remains the same, then the resource will not be marked for update
-	src := d.Get("source").(string)
-	srcImg, exists, err := getRemoteImage(src)
+// imagesyncRedistribute syncs the image to each destination added to 'destinations', and deletes it (per
+// 'on_destroy') from each one removed. Destinations in both are only overwritten if the image itself has changed
+func imagesyncRedistribute(d *schema.ResourceData, c *config) error {
+	o, n := d.GetChange("destinations")
+	oldDests, newDests := o.(*schema.Set), n.(*schema.Set)
+	oldTags, _ := d.GetChange("additional_tags")
+
+	if err := destroyDestinations(d, c, sortedStrings(oldDests.Difference(newDests)), sortedStrings(oldTags.(*schema.Set))); err != nil {
+		return err
+	}
+
+	synced := map[string]interface{}{}
+	for dest, digest := range d.Get("synced_digests").(map[string]interface{}) {
+		if newDests.Contains(dest) {
+			synced[dest] = digest
+		}
+	}
+	if err := d.Set("synced_digests", synced); err != nil {
+		return err
+	}
+
+	if d.HasChange("source_digest") || d.HasChange("destination_digest") {
+		return imagesyncResync(d, c)
+	}
+
+	if d.HasChange("additional_tags") {
+		if err := retagDestinations(d, c, sortedStrings(oldDests.Intersection(newDests))); err != nil {
+			return err
+		}
+	}
+
+	added := sortedStrings(newDests.Difference(oldDests))
+	if len(added) == 0 {
+		return nil
+	}
+
+	c = c.withTransferLimits(resourceTransferLimits(d))
+
+	srcArtifact, err := resolveSource(d, c)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return fmt.Errorf("unable to locate source image at '%s'", src)
+
+	destAuth, err := resourceAuth(d, "destination_auth")
+	if err != nil {
+		return err
 	}
-	srcDigest, err := srcImg.Digest()
+
+	srcDigest, err := srcArtifact.Digest()
 	if err != nil {
 		return err
 	}
 
-	oldDigest := d.Get("source_digest").(string)
-	newDigest := srcDigest.String()
-	if oldDigest != newDigest {
-		d.SetNew("source_digest", newDigest)
+	var mu sync.Mutex
+	additionalTags := sortedStrings(d.Get("additional_tags").(*schema.Set))
+	err = forEachDestination(added, func(dest string) error {
+		if err := writeDestination(c, dest, srcArtifact, additionalTags, destAuth); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		synced[dest] = srcDigest.String()
+		mu.Unlock()
+		return nil
+	})
+	if setErr := d.Set("synced_digests", synced); setErr != nil {
+		return setErr
 	}
 
-	return nil
+	return err
 }
 
-func authOption(ref name.Reference) (remote.Option, error) {
-	reg := ref.Context().Registry
+// imagesyncRetag applies any additional tags added since the last apply, and removes any that have been removed
+func imagesyncRetag(d *schema.ResourceData, c *config) error {
+	return retagDestinations(d, c, resourceDestinations(d))
+}
 
-	switch {
-	case registryIn(reg, "gcr.io", "eu.gcr.io", "us.gcr.io", "asia.gcr.io"):
-		googleAuth, err := google.NewEnvAuthenticator()
+// retagDestinations applies the additional tag changes of imagesyncRetag to the given destinations alone
+func retagDestinations(d *schema.ResourceData, c *config, dests []string) error {
+	destAuth, err := resourceAuth(d, "destination_auth")
+	if err != nil {
+		return err
+	}
+
+	o, n := d.GetChange("additional_tags")
+	removed := sortedStrings(o.(*schema.Set).Difference(n.(*schema.Set)))
+	added := sortedStrings(n.(*schema.Set).Difference(o.(*schema.Set)))
+
+	return forEachDestination(dests, func(dest string) error {
+		if err := untagDestination(c, dest, removed, destAuth); err != nil {
+			return err
+		}
+
+		if len(added) == 0 {
+			return nil
+		}
+
+		destDesc, exists, err := getRemoteDescriptor(dest, c, destAuth)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("unable to locate image at '%s' to tag", dest)
+		}
+
+		return tagDestination(c, dest, destDesc, added, destAuth)
+	})
+}
+
+// resolveSource locates the source image, returning the artifact that should be pushed to every destination. If
+// the source had to be converted from schema1, the digest of the converted image is recorded in 'converted_digest'.
+// Having been located, the source is recorded as available, which isn't checked when planning for pinned sources
+func resolveSource(d *schema.ResourceData, c *config) (artifact, error) {
+	srcAuth, err := resourceAuth(d, "source_auth")
+	if err != nil {
+		return nil, err
+	}
+
+	src := d.Get("source").(string)
+	srcDesc, exists, err := getRemoteDescriptor(src, c, srcAuth)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("unable to locate source image at '%s'", src)
+	}
+
+	var srcArtifact artifact
+	if isSchema1(srcDesc.MediaType) {
+		srcArtifact, err = resolveSchema1Source(d, c, srcDesc, srcAuth)
+	} else {
+		srcArtifact, err = resolveArtifact(srcDesc, resourcePlatforms(d))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	convertedDigest := ""
+	if isSchema1(srcDesc.MediaType) {
+		digest, err := srcArtifact.Digest()
 		if err != nil {
 			return nil, err
 		}
-		return remote.WithAuth(googleAuth), nil
-	default:
-		return remote.WithAuth(authn.Anonymous), nil
+		convertedDigest = digest.String()
+	}
+	if err := d.Set("converted_digest", convertedDigest); err != nil {
+		return nil, err
+	}
+	if err := d.Set("source_available", true); err != nil {
+		return nil, err
+	}
+
+	destArtifact, err := formatArtifact(srcArtifact, d.Get("manifest_format").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve the digest once up front, so every destination shares the same (fully computed) artifact
+	if _, err := destArtifact.Digest(); err != nil {
+		return nil, err
 	}
+
+	return destArtifact, nil
 }
 
-func registryIn(r name.Registry, in ...string) bool {
-	for _, s := range in {
-		if r.Name() == s {
-			return true
+// resolveSchema1Source converts a schema1 source into a schema2 image, so long as the resource allows it
+func resolveSchema1Source(d *schema.ResourceData, c *config, srcDesc *remote.Descriptor, auth authn.Authenticator) (artifact, error) {
+	if !d.Get("convert_schema1").(bool) {
+		return nil, errSchema1Source(d.Get("source").(string))
+	}
+
+	srcOpts, err := c.remoteOptions(srcDesc.Ref, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return convertSchema1(srcDesc, srcOpts...)
+}
+
+func errSchema1Source(src string) error {
+	return fmt.Errorf("'%s' is a Docker schema1 image, which can only be synced with 'convert_schema1' set", src)
+}
+
+// writeDestination pushes the artifact to dest, then applies each of the additional tags to it
+func writeDestination(c *config, dest string, a artifact, additionalTags []string, auth authn.Authenticator) error {
+	// Each write gets a context of its own, so abandoning one write never cancels the uploads of another
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	c = c.withContext(withUnreplayedRequests(ctx))
+
+	destRef, err := c.parseReference(dest)
+	if err != nil {
+		return err
+	}
+
+	destOpts, err := c.remoteOptions(destRef, auth)
+	if err != nil {
+		return err
+	}
+
+	// Should a blob upload fail partway through, the write is attempted again. Any blobs already uploaded are found
+	// to exist on the next attempt, so only the remainder are uploaded. Upload sessions left behind by a failed
+	// attempt are cancelled at the registry
+	err = c.retry.do(c.ctx, func() error {
+		err := writeArtifact(destRef, a, destOpts...)
+		if err != nil {
+			c.uploads.abort(c.ctx)
 		}
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
-	return false
+	return tagDestination(c, dest, a, additionalTags, auth)
+}
+
+func imagesyncRead(d *schema.ResourceData, m interface{}) error {
+	return readDestinations(d, m, true)
+}
+
+// readDestinations records what every destination holds. With syncedOnly, destinations left out of the
+// 'synced_digests' of an earlier sync (e.g. by a failed apply) are treated as missing, without contacting them
+func readDestinations(d *schema.ResourceData, m interface{}, syncedOnly bool) error {
+	ctx, cancel := context.WithTimeout(m.(*config).ctx, d.Timeout(schema.TimeoutRead))
+	defer cancel()
+
+	c := m.(*config).withContext(ctx)
+
+	destAuth, err := resourceAuth(d, "destination_auth")
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu          sync.Mutex
+		destDigests = map[string]interface{}{}
+		staleTags   = map[string]bool{}
+	)
+
+	additionalTags := sortedStrings(d.Get("additional_tags").(*schema.Set))
+
+	dests := resourceDestinations(d)
+	if len(dests) == 0 {
+		return fmt.Errorf("unable to read '%s', as neither 'destination' nor 'destinations' is set", d.Id())
+	}
+
+	// State written before 'synced_digests' existed, or just imported, records no digests, so all are read
+	synced := d.Get("synced_digests").(map[string]interface{})
+
+	err = forEachDestination(dests, func(dest string) error {
+		if _, ok := synced[dest]; syncedOnly && len(synced) > 0 && !ok {
+			return nil
+		}
+
+		destDesc, exists, err := getRemoteDigest(dest, c, destAuth)
+		if err != nil || !exists {
+			return err
+		}
+
+		mu.Lock()
+		destDigests[dest] = destDesc.Digest.String()
+		mu.Unlock()
+
+		// Any additional tag that's gone missing, or been moved to another image, is dropped from state so
+		// that it gets applied again
+		destRef, err := c.parseReference(dest)
+		if err != nil {
+			return err
+		}
+		for _, tag := range additionalTags {
+			tagDesc, exists, err := getRemoteDigest(destRef.Context().Tag(tag).String(), c, destAuth)
+			if err != nil {
+				return err
+			}
+
+			if !exists || tagDesc.Digest != destDesc.Digest {
+				mu.Lock()
+				staleTags[tag] = true
+				mu.Unlock()
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(destDigests) == 0 {
+		// Every destination is missing; have the next apply sync to every destination again
+		d.SetId("")
+		return nil
+	}
+
+	if len(destDigests) != len(dests) {
+		// Any destination that's gone missing is dropped from state, so that the next apply syncs to it again
+		var present []string
+		for _, dest := range dests {
+			if _, ok := destDigests[dest]; ok {
+				present = append(present, dest)
+			}
+		}
+		if err := d.Set("destinations", present); err != nil {
+			return err
+		}
+		dests = present
+	}
+
+	// Destinations that disagree with one another can't all hold the image they should, so no single digest is
+	// recorded for them
+	destDigest := destDigests[dests[0]].(string)
+	for _, digest := range destDigests {
+		if digest != destDigest {
+			destDigest = ""
+		}
+	}
+	if err := d.Set("destination_digest", destDigest); err != nil {
+		return err
+	}
+
+	// The source was available when last sync'd for state written before 'source_available' existed
+	if _, ok := d.GetOkExists("source_available"); !ok {
+		if err := d.Set("source_available", true); err != nil {
+			return err
+		}
+	}
+
+	if d.Get("destination").(string) != "" {
+		digest, _ := v1.NewHash(destDigests[dests[0]].(string))
+		d.SetId(imageID(dests[0], digest))
+	} else {
+		// Every destination holds the same image, so the digest alone identifies a fan-out resource
+		d.SetId(destDigests[dests[0]].(string))
+	}
+
+	var currentTags []interface{}
+	for _, tag := range additionalTags {
+		if !staleTags[tag] {
+			currentTags = append(currentTags, tag)
+		}
+	}
+	if err := d.Set("additional_tags", currentTags); err != nil {
+		return err
+	}
+
+	return d.Set("destination_digests", destDigests)
+}
+
+// imagesyncImport imports a resource by its 'destination', e.g. gcr.io/my-private-registry/busybox:1.32. Resources
+// with several 'destinations' are identified by digest alone, so can't be imported
+func imagesyncImport(d *schema.ResourceData, m interface{}) ([]*schema.ResourceData, error) {
+	dest := d.Id()
+	if strings.HasPrefix(dest, "sha256:") {
+		return nil, fmt.Errorf("unable to import '%s'; import by 'destination', as resources with 'destinations' can't be imported", dest)
+	}
+	if _, err := name.ParseReference(dest, name.WeakValidation); err != nil {
+		return nil, fmt.Errorf("unable to import '%s'; expected the 'destination' image reference: %w", dest, err)
+	}
+
+	if err := d.Set("destination", dest); err != nil {
+		return nil, err
+	}
+
+	// Arguments with defaults aren't otherwise set in the imported state
+	for k, s := range imagesync().Schema {
+		if s.Default == nil {
+			continue
+		}
+		if err := d.Set(k, s.Default); err != nil {
+			return nil, err
+		}
+	}
+
+	return []*schema.ResourceData{d}, nil
+}
+
+func imagesyncDelete(d *schema.ResourceData, m interface{}) error {
+	ctx, cancel := context.WithTimeout(m.(*config).ctx, d.Timeout(schema.TimeoutDelete))
+	defer cancel()
+
+	c := m.(*config).withContext(ctx)
+
+	return destroyDestinations(d, c, resourceDestinations(d), sortedStrings(d.Get("additional_tags").(*schema.Set)))
+}
+
+// destroyDestinations deletes the image from each of the given destinations, along with the given additional tags,
+// as 'on_destroy' dictates
+func destroyDestinations(d *schema.ResourceData, c *config, dests, additionalTags []string) error {
+	onDestroy := d.Get("on_destroy").(string)
+	if onDestroy == destroyRetain || len(dests) == 0 {
+		return nil // Every destination is left exactly as it is
+	}
+
+	destAuth, err := resourceAuth(d, "destination_auth")
+	if err != nil {
+		return err
+	}
+
+	destDigests := d.Get("destination_digests").(map[string]interface{})
+	synced := d.Get("synced_digests").(map[string]interface{})
+
+	return forEachDestination(dests, func(dest string) error {
+		digest, _ := synced[dest].(string)
+		if digest == "" && len(synced) > 0 {
+			return nil // Never sync'd to, so there's nothing to delete
+		}
+		if digest == "" {
+			digest, _ = destDigests[dest].(string) // State written before 'synced_digests' existed
+		}
+		if digest == "" {
+			digest = digestFromReference(d.Id()) // State written before 'destination_digests' existed
+		}
+
+		return deleteDestination(c, dest, digest, additionalTags, onDestroy == destroyDeleteManifest, destAuth)
+	})
+}
+
+// deleteDestination deletes the dest tag along with each of the additional tags. With deleteManifest, the manifest
+// they pointed to (by digest) is deleted too, if no other tag within the repository still references it. Registries
+// that only delete manifests by digest have the manifest deleted in place of the tags, subject to the same check
+func deleteDestination(c *config, dest, digest string, additionalTags []string, deleteManifest bool, auth authn.Authenticator) error {
+	destRef, err := c.parseReference(dest)
+	if err != nil {
+		return err
+	}
+
+	destOpts, err := c.remoteOptions(destRef, auth)
+	if err != nil {
+		return err
+	}
+
+	// The additional tags are removed first, so they aren't mistaken for other images relying on the same layers
+	repo := destRef.Context()
+	tags := append([]string{}, additionalTags...)
+	if tag, ok := destRef.(name.Tag); ok {
+		tags = append(tags, tag.TagStr())
+	}
+
+	for i, tag := range tags {
+		err := remote.Delete(repo.Tag(tag), destOpts...)
+		switch {
+		case err == nil, isNotFound(err):
+			continue
+		case isDeleteUnsupported(err) && deleteManifest && digest != "":
+			return deleteTaggedManifest(repo, digest, tags[i:], destOpts...)
+		case isDeleteUnsupported(err):
+			return fmt.Errorf("registry refused to delete tag '%s', as it only deletes manifests by digest; set "+
+				"'on_destroy' to 'delete_manifest' to delete the manifest instead, or to 'retain' to leave it in place: %w", tag, err)
+		default:
+			return deleteRefusedError(fmt.Sprintf("tag '%s'", tag), err)
+		}
+	}
+
+	if !deleteManifest {
+		return nil
+	}
+
+	// Digest destinations name the manifest itself, so it is deleted regardless of any other tag
+	if _, ok := destRef.(name.Digest); ok {
+		if err := remote.Delete(destRef, destOpts...); err != nil && !isNotFound(err) {
+			return deleteRefusedError(fmt.Sprintf("manifest %s", destRef.Identifier()), err)
+		}
+		return nil
+	}
+
+	if digest == "" {
+		return nil
+	}
+
+	return deleteUnreferencedManifest(repo, digest, destOpts...)
+}
+
+// deleteTaggedManifest deletes the manifest with the given digest, removing the given tags along with it. As every
+// other tag referring to the manifest would be removed too, the manifest is only deleted if there are none
+func deleteTaggedManifest(repo name.Repository, digest string, tags []string, options ...remote.Option) error {
+	other, listed, err := referencingTag(repo, digest, tags, options...)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !listed:
+		return fmt.Errorf("registry only deletes manifests by digest, but can't list tags to check whether any "+
+			"other tag refers to %s; set 'on_destroy' to 'retain' to leave it in place", digest)
+	case other != "":
+		return fmt.Errorf("registry only deletes manifests by digest, and %s is still referenced by tag '%s'; "+
+			"set 'on_destroy' to 'retain' to leave it in place", digest, other)
+	}
+
+	if err := remote.Delete(repo.Digest(digest), options...); err != nil && !isNotFound(err) {
+		return deleteRefusedError(fmt.Sprintf("manifest %s", digest), err)
+	}
+
+	return nil
+}
+
+// deleteUnreferencedManifest deletes the manifest with the given digest from repo, unless a tag within repo still
+// refers to it
+func deleteUnreferencedManifest(repo name.Repository, digest string, options ...remote.Option) error {
+	other, listed, err := referencingTag(repo, digest, nil, options...)
+	if err != nil {
+		return err
+	}
+
+	if !listed || other != "" {
+		return nil // Another image may be using the same layers as we are, do not delete these layers!
+	}
+
+	// No other tag references these layers, we're free to delete
+	if err := remote.Delete(repo.Digest(digest), options...); err != nil && !isNotFound(err) {
+		return deleteRefusedError(fmt.Sprintf("manifest %s", digest), err)
+	}
+
+	return nil
+}
+
+// referencingTag returns a tag within repo, besides any of the ignored tags, that refers to the manifest with the
+// given digest. If the registry doesn't support listing tags, false is returned
+func referencingTag(repo name.Repository, digest string, ignore []string, options ...remote.Option) (string, bool, error) {
+	// Check through all available tags to see if there are any more images referencing these blobs
+	tags, err := remote.List(repo, options...)
+	if err != nil {
+		if strings.Contains(err.Error(), "METHOD_UNKNOWN") {
+			// If the registry doesn't support listing images, we can't be sure we can safely delete these blobs
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	ignored := map[string]bool{}
+	for _, t := range ignore {
+		ignored[t] = true
+	}
+
+	for _, t := range tags {
+		if ignored[t] {
+			continue
+		}
+
+		desc, err := headDescriptor(repo.Tag(t), options...)
+		if err != nil {
+			return "", false, err
+		}
+
+		if desc.Digest.String() == digest {
+			return t, true, nil
+		}
+	}
+
+	return "", true, nil
+}
+
+// isDeleteUnsupported reports whether err is a registry refusing a kind of delete it doesn't support at all, such as
+// registries that only delete manifests by digest refusing to delete a tag
+func isDeleteUnsupported(err error) bool {
+	var tErr *transport.Error
+	if !errors.As(err, &tErr) {
+		return false
+	}
+
+	if tErr.StatusCode == http.StatusMethodNotAllowed {
+		return true
+	}
+	for _, diag := range tErr.Errors {
+		if diag.Code == transport.UnsupportedErrorCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deleteRefusedError describes why the registry refused to delete what, where the reason is known
+func deleteRefusedError(what string, err error) error {
+	var tErr *transport.Error
+	if errors.As(err, &tErr) {
+		switch {
+		case tErr.StatusCode == http.StatusUnauthorized || tErr.StatusCode == http.StatusForbidden:
+			return fmt.Errorf("registry refused to delete %s, as the destination credentials aren't permitted to "+
+				"delete; set 'on_destroy' to 'retain' to leave it in place: %w", what, err)
+		case isDeleteUnsupported(err):
+			return fmt.Errorf("registry refused to delete %s, as it doesn't support deletes; set 'on_destroy' to "+
+				"'retain' to leave it in place: %w", what, err)
+		}
+	}
+
+	return fmt.Errorf("unable to delete %s: %w", what, err)
+}
+
+func destinationsDiffFunc(d *schema.ResourceDiff, v interface{}) error {
+	// 'destination' and 'destinations' conflict with one another, but one of them must be set. Values that are
+	// unknown until apply can't be checked until then
+	if !d.NewValueKnown("destination") || !d.NewValueKnown("destinations") {
+		return nil
+	}
+
+	if d.Get("destination").(string) == "" && d.Get("destinations").(*schema.Set).Len() == 0 {
+		return fmt.Errorf("one of 'destination' or 'destinations' must be set")
+	}
+
+	return nil
+}
+
+func destinationChangedDiffFunc(d *schema.ResourceDiff, v interface{}) error {
+	// A new 'destination' within the same registry can be handled by moving the existing image, so long as the
+	// image itself isn't changing too. Anything else requires a full tear-down, re-sync cycle
+	if d.Id() == "" || !d.HasChange("destination") {
+		return nil
+	}
+
+	o, n := d.GetChange("destination")
+	imageChanged := d.HasChange("source_digest") || d.HasChange("destination_digest")
+	if d.NewValueKnown("destination") && !imageChanged && sameRegistry(o.(string), n.(string)) {
+		return nil
+	}
+
+	return d.ForceNew("destination")
+}
+
+func sourceChangedDiffFunc(d *schema.ResourceDiff, v interface{}) error {
+	// Several things could have changed with the 'source', it could be that:
+	// - the user wants to use a different image
+	// - the source image in the registry has changed
+	// - the user wants the same image, but from a different registry
+	// If the first 2 are true, the digest will change, and so every destination will be overwritten (or, with the
+	// 'recreate' replace_strategy, 'ForceNew' will be triggered).
+	// If the image digest remains the same, then the resource will not be marked for update
+	c := v.(*config)
+
+	src := d.Get("source").(string)
+	if digest, ok := pinnedDigest(src); ok && !d.Get("verify_source_on_plan").(bool) {
+		if planned, err := pinnedSourceDiff(d, digest); planned || err != nil {
+			return err
+		}
+	}
+
+	srcAuth, err := resourceAuth(d, "source_auth")
+	if err != nil {
+		return err
+	}
+
+	srcDesc, exists, err := getRemoteDigest(src, c, srcAuth)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sourceMissingDiff(d, src)
+	}
+
+	if !d.Get("source_available").(bool) {
+		if err := d.SetNew("source_available", true); err != nil {
+			return err
+		}
+	}
+
+	// Schema1 images are tracked by the digest of the original manifest; the converted image is only built when
+	// syncing, as building it means reading every layer
+	if isSchema1(srcDesc.MediaType) && !d.Get("convert_schema1").(bool) {
+		return errSchema1Source(src)
+	}
+
+	// When filtering by platform, the digest of interest is that of the filtered index; changes upstream to
+	// platforms we don't sync shouldn't trigger a re-sync. Filtering an index, like writing in another manifest
+	// format, needs the manifests themselves. Otherwise, the digest alone will do
+	srcDigest := srcDesc.Digest
+	var srcArtifact artifact
+	filtered := isIndex(srcDesc.MediaType) && len(resourcePlatforms(d)) > 0
+	formatted := d.Get("manifest_format").(string) != manifestFormatPreserve
+	if !isSchema1(srcDesc.MediaType) && (filtered || formatted) {
+		fullDesc, exists, err := getRemoteDescriptor(src, c, srcAuth)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return sourceMissingDiff(d, src)
+		}
+
+		if srcArtifact, err = resolveArtifact(fullDesc, resourcePlatforms(d)); err != nil {
+			return err
+		}
+		if srcDigest, err = srcArtifact.Digest(); err != nil {
+			return err
+		}
+	}
+
+	if isSchema1(srcDesc.MediaType) && d.Get("source_digest").(string) != srcDigest.String() {
+		if err := d.SetNewComputed("converted_digest"); err != nil {
+			return err
+		}
+	}
+
+	if err := sourceDigestDiff(d, srcDigest.String()); err != nil {
+		return err
+	}
+
+	return destinationDigestDiff(d, srcDesc.MediaType, srcDigest, srcArtifact)
+}
+
+// sourceDigestDiff plans for the 'source_digest' to change to digest, if it differs. With the 'recreate'
+// replace_strategy, a new digest replaces the resource entirely
+func sourceDigestDiff(d *schema.ResourceDiff, digest string) error {
+	if d.Get("source_digest").(string) == digest {
+		return nil
+	}
+
+	if err := d.SetNew("source_digest", digest); err != nil {
+		return err
+	}
+
+	if d.Id() != "" && d.Get("replace_strategy").(string) == replaceStrategyRecreate {
+		return d.ForceNew("source_digest")
+	}
+
+	return nil
+}
+
+// pinnedDigest returns the digest src is pinned to, if it refers to its image by digest rather than by tag
+func pinnedDigest(src string) (string, bool) {
+	ref, err := name.ParseReference(src, name.WeakValidation)
+	if err != nil {
+		return "", false
+	}
+
+	digest, ok := ref.(name.Digest)
+	if !ok {
+		return "", false
+	}
+
+	return digest.DigestStr(), true
+}
+
+// pinnedSourceDiff plans a resource with a 'source' pinned to a digest without contacting the source registry, as
+// the image behind a digest never changes. Images not synced as-is return false when their manifests are needed
+func pinnedSourceDiff(d *schema.ResourceDiff, digest string) (bool, error) {
+	asIs := len(resourcePlatforms(d)) == 0 && d.Get("manifest_format").(string) == manifestFormatPreserve &&
+		!d.Get("convert_schema1").(bool)
+
+	if !asIs {
+		// The 'source_digest' (e.g. of a filtered index) can only change along with the settings that produce it
+		reconfigured := d.Id() == "" || d.HasChange("source") || d.HasChange("platforms") ||
+			d.HasChange("manifest_format") || d.HasChange("convert_schema1")
+		if reconfigured {
+			return false, nil
+		}
+
+		// Otherwise, the destinations should still hold the image last sync'd to them
+		if destDigest := syncedDigest(d); destDigest != "" {
+			return true, planDestinationDigest(d, destDigest)
+		}
+		return true, nil
+	}
+
+	if err := sourceDigestDiff(d, digest); err != nil {
+		return true, err
+	}
+
+	return true, planDestinationDigest(d, digest)
+}
+
+// sourceMissingDiff handles a 'source' that can no longer be found upstream, which is only ever an error when there's
+// no image already sync'd to keep (or when the 'source' itself has been changed). Otherwise, per 'on_source_missing',
+// every destination is left holding the image last sync'd from the source. With no source to compare against,
+// destinations can't be checked for drift until the source is available again
+func sourceMissingDiff(d *schema.ResourceDiff, src string) error {
+	onMissing := d.Get("on_source_missing").(string)
+	if d.Id() == "" || d.HasChange("source") || onMissing == sourceMissingFail {
+		return fmt.Errorf("unable to locate source image at '%s'", src)
+	}
+
+	if onMissing == sourceMissingWarn {
+		log.Printf("[WARN] unable to locate source image at '%s'; keeping the image already sync'd to each destination", src)
+	}
+
+	if d.Get("source_available").(bool) {
+		return d.SetNew("source_available", false)
+	}
+
+	return nil
+}
+
+// destinationDigestDiff plans the digest every destination should hold, which differs from the 'source_digest'
+// whenever the image is written in another 'manifest_format'. As refreshing records the digest the destinations
+// actually hold, any destination holding anything else is re-synced. srcArtifact is only needed when the source
+// isn't written as it is upstream
+func destinationDigestDiff(d *schema.ResourceDiff, srcMediaType types.MediaType, srcDigest v1.Hash, srcArtifact artifact) error {
+	if isSchema1(srcMediaType) {
+		// Converted schema1 images aren't built until they're synced, so a new image can only be compared once
+		// synced. Otherwise, the destinations should still hold the converted image they were sync'd with
+		if d.Id() == "" || d.HasChange("source_digest") || d.HasChange("manifest_format") {
+			return d.SetNewComputed("destination_digest")
+		}
+
+		destDigest := d.Get("converted_digest").(string)
+		if d.Get("manifest_format").(string) != manifestFormatPreserve {
+			destDigest = syncedDigest(d)
+		}
+		if destDigest == "" {
+			return nil // State written before the digest of the converted image was recorded
+		}
+
+		return planDestinationDigest(d, destDigest)
+	}
+
+	if srcArtifact == nil {
+		return planDestinationDigest(d, srcDigest.String())
+	}
+
+	destArtifact, err := formatArtifact(srcArtifact, d.Get("manifest_format").(string))
+	if err != nil {
+		return err
+	}
+
+	destDigest, err := destArtifact.Digest()
+	if err != nil {
+		return err
+	}
+
+	return planDestinationDigest(d, destDigest.String())
+}
+
+// planDestinationDigest plans for every destination to hold the image with the given digest. Unless the image
+// itself has changed, destinations holding anything else must have drifted from the image they were sync'd with,
+// which is handled per 'on_destination_drift'
+func planDestinationDigest(d *schema.ResourceDiff, destDigest string) error {
+	current := d.Get("destination_digest").(string)
+	if current == destDigest {
+		return nil
+	}
+
+	// Refreshing leaves no digest recorded when destinations hold different images to one another
+	imageChanged := d.HasChange("source_digest") || d.HasChange("manifest_format") || d.HasChange("platforms")
+	if !imageChanged && d.Id() != "" {
+		switch d.Get("on_destination_drift").(string) {
+		case destinationDriftError:
+			if current == "" {
+				return fmt.Errorf("destinations no longer all hold %s, the image they were sync'd with", destDigest)
+			}
+			return fmt.Errorf("destination holds %s rather than %s, the image it was sync'd with", current, destDigest)
+		case destinationDriftIgnore:
+			return nil
+		}
+	}
+
+	return d.SetNew("destination_digest", destDigest)
+}
+
+// syncedDigest returns the digest of the image last sync'd to every destination, or "" if they weren't all sync'd
+// with the same image
+func syncedDigest(d interface{ Get(string) interface{} }) string {
+	digest := ""
+	for _, raw := range d.Get("synced_digests").(map[string]interface{}) {
+		switch {
+		case digest == "":
+			digest = raw.(string)
+		case raw.(string) != digest:
+			return ""
+		}
+	}
+
+	return digest
+}
+
+// resourceTransferLimits returns the limits for uploads made on behalf of this resource alone, or nil if there
+// are none
+func resourceTransferLimits(d *schema.ResourceData) *transferLimits {
+	return newTransferLimits(map[string]interface{}{
+		"max_concurrent_uploads":      d.Get("max_concurrent_uploads"),
+		"max_upload_bytes_per_second": d.Get("max_upload_bytes_per_second"),
+	})
+}
+
+// sameRegistry reports whether both references refer to images within the same registry
+func sameRegistry(a, b string) bool {
+	aRef, err := name.ParseReference(a, name.WeakValidation)
+	if err != nil {
+		return false
+	}
+
+	bRef, err := name.ParseReference(b, name.WeakValidation)
+	if err != nil {
+		return false
+	}
+
+	return aRef.Context().RegistryStr() == bRef.Context().RegistryStr()
 }
 
-func ipFromRegistry(reg string) net.IP {
-	if i := strings.Index(reg, ":"); i != -1 && i < len(reg) {
-		reg = reg[:i]
+// resourcePlatforms returns the platforms an index should be filtered down to, or nil if every platform should
+// be synced. Platforms have already been validated by the schema
+func resourcePlatforms(d interface{ Get(string) interface{} }) []v1.Platform {
+	var platforms []v1.Platform
+	for _, raw := range d.Get("platforms").([]interface{}) {
+		p, _ := parsePlatform(raw.(string))
+		platforms = append(platforms, p)
 	}
 
-	return net.ParseIP(reg)
+	return platforms
 }
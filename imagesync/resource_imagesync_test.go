@@ -1,26 +1,42 @@
 package imagesync_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/sHesl/terraform-provider-imagesync/imagesync"
 
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/registry" // Modified to allow registry deletes
+	"github.com/google/go-containerregistry/pkg/registry"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/hashicorp/terraform/helper/resource"
 	"github.com/hashicorp/terraform/terraform"
 )
 
 func TestImageSync(t *testing.T) {
-	srcReg := httptest.NewServer(registry.New())
+	srcReg := httptest.NewServer(newFakeRegistry())
 	defer srcReg.Close()
 
-	destReg := httptest.NewServer(registry.New())
+	destReg := httptest.NewServer(newFakeRegistry())
 	defer destReg.Close()
 
 	fakeImg, _ := random.Image(10, 1)
@@ -121,12 +137,1890 @@ func TestImageSync(t *testing.T) {
 }
 
 func initSrcImage(fakeReg *httptest.Server, path string, img v1.Image) {
+	initSrcImageWithAuth(fakeReg, path, img, authn.Anonymous)
+}
+
+func initSrcImageWithAuth(fakeReg *httptest.Server, path string, img v1.Image, auth authn.Authenticator) {
+	ref, err := name.ParseReference(fakeReg.URL[7:]+"/"+path, name.WeakValidation)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := remote.Write(ref, img, remote.WithAuth(auth)); err != nil {
+		panic(err)
+	}
+}
+
+func TestImageSyncRegistryAuth(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(basicAuthHandler("mirror", "hunter2", newFakeRegistry()))
+	defer destReg.Close()
+
+	fakeImg, _ := random.Image(10, 1)
+	fakeImgDigest, _ := fakeImg.Digest()
+	initSrcImage(srcReg, "library/busybox:1.0", fakeImg)
+
+	stubImageSyncAuthConfig := func(password string) string {
+		return fmt.Sprintf(`provider "imagesync" {
+			registry_auth {
+				address  = "%s"
+				username = "mirror"
+				password = "%s"
+			}
+		}
+
+		resource "imagesync" "auth_unit_test" {
+			source      = "%s/library/busybox:1.0"
+			destination = "%s/busybox:1.0"
+		}`, destReg.URL[7:], password, srcReg.URL[7:], destReg.URL[7:])
+	}
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				// Pushing with the wrong credentials must fail
+				Config:      stubImageSyncAuthConfig("wrong"),
+				ExpectError: regexp.MustCompile("UNAUTHORIZED|401"),
+			},
+			{
+				// Pushing with the configured credentials succeeds
+				Config: stubImageSyncAuthConfig("hunter2"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.auth_unit_test", "id", destReg.URL[7:]+"/busybox@"+fakeImgDigest.String()),
+					resource.TestCheckResourceAttr("imagesync.auth_unit_test", "source_digest", fakeImgDigest.String()),
+				),
+			},
+		},
+	})
+}
+
+// basicAuthHandler rejects any request to the wrapped registry that doesn't carry the given basic credentials
+func basicAuthHandler(username, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="imagesync"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestImageSyncDockerConfig(t *testing.T) {
+	srcReg := httptest.NewServer(basicAuthHandler("helper", "s3cret", newFakeRegistry()))
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(basicAuthHandler("mirror", "hunter2", newFakeRegistry()))
+	defer destReg.Close()
+
+	fakeImg, _ := random.Image(10, 1)
+	fakeImgDigest, _ := fakeImg.Digest()
+	initSrcImageWithAuth(srcReg, "library/busybox:1.0", fakeImg, &authn.Basic{Username: "helper", Password: "s3cret"})
+
+	// Source credentials come from a credential helper on the PATH, destination credentials from 'auths'
+	dir := t.TempDir()
+	helper := "#!/bin/sh\ncat > /dev/null\necho '{\"ServerURL\":\"" + srcReg.URL[7:] + "\",\"Username\":\"helper\",\"Secret\":\"s3cret\"}'\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker-credential-imagesync-test"), []byte(helper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dockerConfig := fmt.Sprintf(`{
+		"auths": {"%s": {"auth": "%s"}},
+		"credHelpers": {"%s": "imagesync-test"}
+	}`, destReg.URL[7:], base64.StdEncoding.EncodeToString([]byte("mirror:hunter2")), srcReg.URL[7:])
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(dockerConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`provider "imagesync" {
+					use_docker_config  = true
+					docker_config_path = "%s"
+				}
+
+				resource "imagesync" "docker_config_unit_test" {
+					source      = "%s/library/busybox:1.0"
+					destination = "%s/busybox:1.0"
+				}`, configPath, srcReg.URL[7:], destReg.URL[7:]),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.docker_config_unit_test", "id", destReg.URL[7:]+"/busybox@"+fakeImgDigest.String()),
+					resource.TestCheckResourceAttr("imagesync.docker_config_unit_test", "source_digest", fakeImgDigest.String()),
+				),
+			},
+		},
+	})
+}
+
+func TestImageSyncResourceAuth(t *testing.T) {
+	srcReg := httptest.NewServer(basicAuthHandler("vendor", "vendorpw", newFakeRegistry()))
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(basicAuthHandler("mirror", "hunter2", newFakeRegistry()))
+	defer destReg.Close()
+
+	fakeImg, _ := random.Image(10, 1)
+	fakeImgDigest, _ := fakeImg.Digest()
+	initSrcImageWithAuth(srcReg, "library/busybox:1.0", fakeImg, &authn.Basic{Username: "vendor", Password: "vendorpw"})
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				// Resource level credentials override the provider level credentials for the same host
+				Config: fmt.Sprintf(`provider "imagesync" {
+					registry_auth {
+						address  = "%s"
+						username = "someone-else"
+						password = "wrong"
+					}
+				}
+
+				resource "imagesync" "resource_auth_unit_test" {
+					source      = "%s/library/busybox:1.0"
+					destination = "%s/busybox:1.0"
+
+					source_auth {
+						username = "vendor"
+						password = "vendorpw"
+					}
+
+					destination_auth {
+						username = "mirror"
+						password = "hunter2"
+					}
+				}`, srcReg.URL[7:], srcReg.URL[7:], destReg.URL[7:]),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.resource_auth_unit_test", "id", destReg.URL[7:]+"/busybox@"+fakeImgDigest.String()),
+					resource.TestCheckResourceAttr("imagesync.resource_auth_unit_test", "source_digest", fakeImgDigest.String()),
+				),
+			},
+		},
+	})
+}
+
+func TestImageSyncIndex(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(newFakeRegistry())
+	defer destReg.Close()
+
+	fakeIdx, _ := random.Index(10, 1, 3)
+	fakeIdxDigest, _ := fakeIdx.Digest()
+	initSrcIndex(srcReg, "library/busybox:multiarch", fakeIdx)
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				// The whole index is copied, and the index digest (not a platform digest) is recorded
+				Config: fmt.Sprintf(`resource "imagesync" "index_unit_test" {
+					source      = "%s/library/busybox:multiarch"
+					destination = "%s/busybox:multiarch"
+				}`, srcReg.URL[7:], destReg.URL[7:]),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.index_unit_test", "id", destReg.URL[7:]+"/busybox@"+fakeIdxDigest.String()),
+					resource.TestCheckResourceAttr("imagesync.index_unit_test", "source_digest", fakeIdxDigest.String()),
+					checkIndexChildrenExist(destReg.URL[7:]+"/busybox", fakeIdx),
+				),
+			},
+		},
+	})
+}
+
+// checkIndexChildrenExist verifies every child manifest (and its layers) of idx have been copied into repo
+func checkIndexChildrenExist(repo string, idx v1.ImageIndex) resource.TestCheckFunc {
+	return func(*terraform.State) error {
+		im, err := idx.IndexManifest()
+		if err != nil {
+			return err
+		}
+
+		for _, child := range im.Manifests {
+			ref, err := name.ParseReference(repo+"@"+child.Digest.String(), name.WeakValidation)
+			if err != nil {
+				return err
+			}
+
+			img, err := remote.Image(ref)
+			if err != nil {
+				return fmt.Errorf("child manifest %s missing from destination: %w", child.Digest, err)
+			}
+
+			layers, err := img.Layers()
+			if err != nil {
+				return err
+			}
+			for _, l := range layers {
+				if _, err := l.Compressed(); err != nil {
+					return fmt.Errorf("layer of child manifest %s missing from destination: %w", child.Digest, err)
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+func initSrcIndex(fakeReg *httptest.Server, path string, idx v1.ImageIndex) {
+	ref, err := name.ParseReference(fakeReg.URL[7:]+"/"+path, name.WeakValidation)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		panic(err)
+	}
+}
+
+func TestImageSyncPlatforms(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(newFakeRegistry())
+	defer destReg.Close()
+
+	var adds []mutate.IndexAddendum
+	for _, p := range []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "linux", Architecture: "s390x"},
+		{OS: "windows", Architecture: "amd64"},
+	} {
+		p := p
+		img, _ := random.Image(10, 1)
+		adds = append(adds, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &p}})
+	}
+	fakeIdx := mutate.AppendManifests(empty.Index, adds...)
+	initSrcIndex(srcReg, "library/busybox:multiarch", fakeIdx)
+
+	// The index we expect to be synced, containing only the linux/amd64 and linux/arm64 images
+	wantIdx := mutate.AppendManifests(empty.Index, adds[:2]...)
+	wantIdxDigest, _ := wantIdx.Digest()
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`resource "imagesync" "platforms_unit_test" {
+					source      = "%s/library/busybox:multiarch"
+					destination = "%s/busybox:multiarch"
+					platforms   = ["linux/amd64", "linux/arm64"]
+				}`, srcReg.URL[7:], destReg.URL[7:]),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.platforms_unit_test", "id", destReg.URL[7:]+"/busybox@"+wantIdxDigest.String()),
+					resource.TestCheckResourceAttr("imagesync.platforms_unit_test", "source_digest", wantIdxDigest.String()),
+					checkIndexChildrenExist(destReg.URL[7:]+"/busybox", wantIdx),
+				),
+			},
+			{
+				Config: fmt.Sprintf(`resource "imagesync" "platforms_unit_test" {
+					source      = "%s/library/busybox:multiarch"
+					destination = "%s/busybox:multiarch"
+					platforms   = ["linux/ppc64le"]
+				}`, srcReg.URL[7:], destReg.URL[7:]),
+				ExpectError: regexp.MustCompile("no images in the index match any of the requested platforms"),
+			},
+		},
+	})
+}
+
+func TestImageSyncManifestFormat(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(newFakeRegistry())
+	defer destReg.Close()
+
+	fakeImg, _ := random.Image(10, 2)
+	fakeImgDigest, _ := fakeImg.Digest()
+	initSrcImage(srcReg, "library/busybox:1.32", fakeImg)
+
+	fakeIdx, _ := random.Index(10, 1, 2)
+	fakeIdxDigest, _ := fakeIdx.Digest()
+	initSrcIndex(srcReg, "library/busybox:multiarch", fakeIdx)
+
+	stubConfig := func(format string) string {
+		return fmt.Sprintf(`resource "imagesync" "format_unit_test" {
+			source          = "%[1]s/library/busybox:1.32"
+			destination     = "%[2]s/busybox:1.32"
+			manifest_format = "%[3]s"
+		}
+
+		resource "imagesync" "format_index_unit_test" {
+			source          = "%[1]s/library/busybox:multiarch"
+			destination     = "%[2]s/busybox:multiarch"
+			manifest_format = "%[3]s"
+		}`, srcReg.URL[7:], destReg.URL[7:], format)
+	}
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: stubConfig("oci"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.format_unit_test", "source_digest", fakeImgDigest.String()),
+					resource.TestCheckResourceAttr("imagesync.format_index_unit_test", "source_digest", fakeIdxDigest.String()),
+					checkManifestFormat("imagesync.format_unit_test", destReg.URL[7:]+"/busybox:1.32", types.OCIManifestSchema1, types.OCIConfigJSON, types.OCILayer),
+					checkManifestFormat("imagesync.format_index_unit_test", destReg.URL[7:]+"/busybox:multiarch", types.OCIImageIndex, types.OCIConfigJSON, types.OCILayer),
+				),
+			},
+			{
+				// Nothing upstream has changed, and the destinations already hold the converted images
+				Config:   stubConfig("oci"),
+				PlanOnly: true,
+			},
+			{
+				// The source image is already in the Docker format, so is written as it is upstream. The source index is
+				// an OCI index of Docker images, so only the index itself is converted
+				Config: stubConfig("docker"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.format_unit_test", "destination_digest", fakeImgDigest.String()),
+					checkManifestFormat("imagesync.format_unit_test", destReg.URL[7:]+"/busybox:1.32", types.DockerManifestSchema2, types.DockerConfigJSON, types.DockerLayer),
+					checkManifestFormat("imagesync.format_index_unit_test", destReg.URL[7:]+"/busybox:multiarch", types.DockerManifestList, types.DockerConfigJSON, types.DockerLayer),
+				),
+			},
+		},
+	})
+}
+
+// checkManifestFormat verifies the artifact at dest uses the given media types throughout, and that its digest is
+// recorded as the 'destination_digest' of the resource
+func checkManifestFormat(resourceName, dest string, mt, configMT, layerMT types.MediaType) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		ref, err := name.ParseReference(dest, name.WeakValidation)
+		if err != nil {
+			return err
+		}
+
+		desc, err := remote.Get(ref)
+		if err != nil {
+			return err
+		}
+		if desc.MediaType != mt {
+			return fmt.Errorf("expected %s to have media type %s, got %s", dest, mt, desc.MediaType)
+		}
+
+		rs := s.RootModule().Resources[resourceName]
+		if got := rs.Primary.Attributes["destination_digest"]; got != desc.Digest.String() {
+			return fmt.Errorf("expected 'destination_digest' to be %s, got %s", desc.Digest, got)
+		}
+
+		var imgs []v1.Image
+		if isIndex := desc.MediaType == types.OCIImageIndex || desc.MediaType == types.DockerManifestList; isIndex {
+			idx, err := desc.ImageIndex()
+			if err != nil {
+				return err
+			}
+			im, err := idx.IndexManifest()
+			if err != nil {
+				return err
+			}
+			for _, child := range im.Manifests {
+				img, err := remote.Image(ref.Context().Digest(child.Digest.String()))
+				if err != nil {
+					return fmt.Errorf("child manifest %s missing from destination: %w", child.Digest, err)
+				}
+				imgs = append(imgs, img)
+			}
+		} else {
+			img, err := desc.Image()
+			if err != nil {
+				return err
+			}
+			imgs = append(imgs, img)
+		}
+
+		for _, img := range imgs {
+			m, err := img.Manifest()
+			if err != nil {
+				return err
+			}
+			if m.Config.MediaType != configMT {
+				return fmt.Errorf("expected config media type %s, got %s", configMT, m.Config.MediaType)
+			}
+			for _, l := range m.Layers {
+				if l.MediaType != layerMT {
+					return fmt.Errorf("expected layer media type %s, got %s", layerMT, l.MediaType)
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+func TestImageSyncConvertSchema1(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(newFakeRegistry())
+	defer destReg.Close()
+
+	schema1Digest, layers := initSrcSchema1Image(srcReg, "legacy/app:1.0")
+	otherImg, _ := random.Image(10, 1)
+
+	stubConfig := func(convert bool, format string) string {
+		return fmt.Sprintf(`resource "imagesync" "schema1_unit_test" {
+			source          = "%s/legacy/app:1.0"
+			destination     = "%s/app:1.0"
+			convert_schema1 = %t
+			manifest_format = "%s"
+		}`, srcReg.URL[7:], destReg.URL[7:], convert, format)
+	}
+
+	// The destination should hold the image the resource last sync'd to it
+	checkSynced := func(s *terraform.State) error {
+		rs := s.RootModule().Resources["imagesync.schema1_unit_test"]
+		return checkTagDigest(destReg.URL[7:]+"/app:1.0", rs.Primary.Attributes["synced_digests."+destReg.URL[7:]+"/app:1.0"])(s)
+	}
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config:      stubConfig(false, "preserve"),
+				ExpectError: regexp.MustCompile("can only be synced with 'convert_schema1' set"),
+			},
+			{
+				Config: stubConfig(true, "preserve"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.schema1_unit_test", "source_digest", schema1Digest),
+					resource.TestCheckResourceAttrPair("imagesync.schema1_unit_test", "destination_digest", "imagesync.schema1_unit_test", "converted_digest"),
+					checkConvertedSchema1(destReg.URL[7:]+"/app:1.0", layers),
+				),
+			},
+			{
+				// Nothing changes upstream, so the converted image is left as it is
+				Config:   stubConfig(true, "preserve"),
+				PlanOnly: true,
+			},
+			{
+				// Another image pushed over the destination is detected against the converted image
+				PreConfig: func() { initSrcImage(destReg, "app:1.0", otherImg) },
+				Config:    stubConfig(true, "preserve"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrPair("imagesync.schema1_unit_test", "destination_digest", "imagesync.schema1_unit_test", "converted_digest"),
+					checkConvertedSchema1(destReg.URL[7:]+"/app:1.0", layers),
+				),
+			},
+			{
+				Config: stubConfig(true, "oci"),
+				Check:  checkSynced,
+			},
+			{
+				// Rewritten in another format, the converted image is detected against the digest last sync'd
+				PreConfig: func() { initSrcImage(destReg, "app:1.0", otherImg) },
+				Config:    stubConfig(true, "oci"),
+				Check:     checkSynced,
+			},
+		},
+	})
+}
+
+// initSrcSchema1Image pushes a schema1 manifest with 2 layers and a throwaway history entry between them, returning
+// the digest of the manifest and the layers, base layer first
+func initSrcSchema1Image(fakeReg *httptest.Server, path string) (string, []v1.Layer) {
 	ref, err := name.ParseReference(fakeReg.URL[7:]+"/"+path, name.WeakValidation)
 	if err != nil {
 		panic(err)
 	}
 
-	if err := remote.Write(ref, img); err != nil {
+	img, _ := random.Image(512, 2)
+	layers, _ := img.Layers()
+	for _, l := range layers {
+		if err := remote.WriteLayer(ref.Context(), l); err != nil {
+			panic(err)
+		}
+	}
+	base, _ := layers[0].Digest()
+	top, _ := layers[1].Digest()
+
+	// Layers and history are listed most recent first
+	manifest := fmt.Sprintf(`{
+		"schemaVersion": 1,
+		"name": "legacy/app",
+		"tag": "1.0",
+		"architecture": "amd64",
+		"fsLayers": [{"blobSum": "%s"}, {"blobSum": "%s"}, {"blobSum": "%s"}],
+		"history": [
+			{"v1Compatibility": %q},
+			{"v1Compatibility": %q},
+			{"v1Compatibility": %q}
+		]
+	}`, top, base, base,
+		`{"id":"c","parent":"b","architecture":"amd64","os":"linux","created":"2016-01-03T00:00:00Z","config":{"Cmd":["/app"],"Env":["PATH=/bin"]},"container_config":{"Cmd":["/bin/sh","-c","#(nop) COPY app /app"]}}`,
+		`{"id":"b","parent":"a","created":"2016-01-02T00:00:00Z","container_config":{"Cmd":["/bin/sh","-c","#(nop) ENV PATH=/bin"]},"throwaway":true}`,
+		`{"id":"a","created":"2016-01-01T00:00:00Z","container_config":{"Cmd":["/bin/sh","-c","#(nop) ADD file:base in /"]}}`,
+	)
+
+	req, _ := http.NewRequest(http.MethodPut, fakeReg.URL+"/v2/legacy/app/manifests/1.0", strings.NewReader(manifest))
+	req.Header.Set("Content-Type", "application/vnd.docker.distribution.manifest.v1+prettyjws")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
 		panic(err)
 	}
+	resp.Body.Close()
+
+	digest, _, _ := v1.SHA256(strings.NewReader(manifest))
+	return digest.String(), layers
+}
+
+// checkConvertedSchema1 verifies the image at dest is a schema2 conversion of the image pushed by
+// initSrcSchema1Image, and that its digest is recorded as the 'converted_digest'
+func checkConvertedSchema1(dest string, layers []v1.Layer) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		ref, err := name.ParseReference(dest, name.WeakValidation)
+		if err != nil {
+			return err
+		}
+
+		desc, err := remote.Get(ref)
+		if err != nil {
+			return err
+		}
+		if desc.MediaType != types.DockerManifestSchema2 {
+			return fmt.Errorf("expected a schema2 manifest at the destination, got %s", desc.MediaType)
+		}
+
+		rs := s.RootModule().Resources["imagesync.schema1_unit_test"]
+		if got := rs.Primary.Attributes["converted_digest"]; got != desc.Digest.String() {
+			return fmt.Errorf("expected 'converted_digest' to be %s, got %s", desc.Digest, got)
+		}
+
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return err
+		}
+
+		if cfg.Architecture != "amd64" || cfg.OS != "linux" || len(cfg.Config.Cmd) != 1 || cfg.Config.Cmd[0] != "/app" {
+			return fmt.Errorf("expected the image config to be taken from the most recent history entry, got %+v", cfg)
+		}
+
+		if len(cfg.History) != 3 || !cfg.History[1].EmptyLayer || cfg.History[0].EmptyLayer || cfg.History[2].EmptyLayer {
+			return fmt.Errorf("expected 3 history entries, with only the second empty, got %+v", cfg.History)
+		}
+		if cfg.History[2].CreatedBy != "/bin/sh -c #(nop) COPY app /app" {
+			return fmt.Errorf("unexpected history for the most recent layer: %+v", cfg.History[2])
+		}
+
+		if len(cfg.RootFS.DiffIDs) != len(layers) {
+			return fmt.Errorf("expected %d layers, got %d", len(layers), len(cfg.RootFS.DiffIDs))
+		}
+		for i, l := range layers {
+			diffID, _ := l.DiffID()
+			if cfg.RootFS.DiffIDs[i] != diffID {
+				return fmt.Errorf("expected layer %d to have diff ID %s, got %s", i, diffID, cfg.RootFS.DiffIDs[i])
+			}
+		}
+
+		return nil
+	}
+}
+
+func TestImageSyncDestinations(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	// Every manifest pushed to the first destination is counted, so we can check it's left alone
+	var euPushes int32
+	euReg := httptest.NewServer(countingHandler(&euPushes, http.MethodPut, "/manifests/", newFakeRegistry()))
+	defer euReg.Close()
+
+	usReg := httptest.NewServer(newFakeRegistry())
+	defer usReg.Close()
+
+	apReg := httptest.NewServer(newFakeRegistry())
+	defer apReg.Close()
+
+	// No credentials are configured for this registry, so every push to it fails
+	lockedReg := httptest.NewServer(basicAuthHandler("user", "pass", newFakeRegistry()))
+	defer lockedReg.Close()
+
+	fakeImg, _ := random.Image(10, 1)
+	fakeImgDigest, _ := fakeImg.Digest()
+	initSrcImage(srcReg, "library/busybox:1.32", fakeImg)
+
+	stubConfig := func(regs ...*httptest.Server) string {
+		var dests []string
+		for _, reg := range regs {
+			dests = append(dests, fmt.Sprintf(`"%s/busybox:1.32"`, reg.URL[7:]))
+		}
+		return fmt.Sprintf(`resource "imagesync" "destinations_unit_test" {
+			source       = "%s/library/busybox:1.32"
+			destinations = [%s]
+		}`, srcReg.URL[7:], strings.Join(dests, ", "))
+	}
+
+	checkNoEUPushes := func(*terraform.State) error {
+		if n := atomic.LoadInt32(&euPushes); n != 0 {
+			return fmt.Errorf("expected the existing destination to be left alone, got %d manifest pushes", n)
+		}
+		return nil
+	}
+
+	partialConfig := stubConfig(euReg, usReg, apReg) + fmt.Sprintf(`
+
+		resource "imagesync" "partial_unit_test" {
+			source       = "%s/library/busybox:1.32"
+			destinations = ["%s/busybox:1.33", "%s/busybox:1.33"]
+		}`, srcReg.URL[7:], euReg.URL[7:], lockedReg.URL[7:])
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: stubConfig(euReg, usReg),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.destinations_unit_test", "id", fakeImgDigest.String()),
+					resource.TestCheckResourceAttr("imagesync.destinations_unit_test", "destination_digests.%", "2"),
+					resource.TestCheckResourceAttr("imagesync.destinations_unit_test", "destination_digests."+euReg.URL[7:]+"/busybox:1.32", fakeImgDigest.String()),
+					resource.TestCheckResourceAttr("imagesync.destinations_unit_test", "destination_digests."+usReg.URL[7:]+"/busybox:1.32", fakeImgDigest.String()),
+				),
+			},
+			{
+				// A new destination is sync'd on its own, leaving the existing destinations in place
+				PreConfig: func() { atomic.StoreInt32(&euPushes, 0) },
+				Config:    stubConfig(euReg, usReg, apReg),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.destinations_unit_test", "destination_digests.%", "3"),
+					checkTagDigest(apReg.URL[7:]+"/busybox:1.32", fakeImgDigest.String()),
+					checkNoEUPushes,
+				),
+			},
+			{
+				// A destination deleted outside of Terraform is sync'd again on its own
+				PreConfig: func() {
+					ref, _ := name.ParseReference(apReg.URL[7:]+"/busybox:1.32", name.WeakValidation)
+					if err := remote.Delete(ref); err != nil {
+						t.Fatal(err)
+					}
+				},
+				Config: stubConfig(euReg, usReg, apReg),
+				Check: resource.ComposeTestCheckFunc(
+					checkTagDigest(apReg.URL[7:]+"/busybox:1.32", fakeImgDigest.String()),
+					checkNoEUPushes,
+				),
+			},
+			{
+				// A removed destination is deleted, leaving the rest in place
+				Config: stubConfig(euReg, apReg),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.destinations_unit_test", "destination_digests.%", "2"),
+					checkTagDigest(usReg.URL[7:]+"/busybox:1.32", ""),
+					checkNoEUPushes,
+				),
+			},
+			{
+				// A failing destination is reported on its own, while the rest are still sync'd
+				Config:      partialConfig,
+				ExpectError: regexp.MustCompile("1 error occurred:\\s+\\* destination '" + regexp.QuoteMeta(lockedReg.URL[7:]) + "/busybox:1.33'"),
+			},
+			{
+				// The destination alongside the failing one was kept in state, so is cleaned up rather than left behind
+				PreConfig: func() {
+					if err := checkTagDigest(euReg.URL[7:]+"/busybox:1.33", fakeImgDigest.String())(nil); err != nil {
+						t.Fatalf("expected image to be sync'd to the healthy destination: %v", err)
+					}
+				},
+				Config: stubConfig(euReg, apReg),
+				Check:  checkTagDigest(euReg.URL[7:]+"/busybox:1.33", ""),
+			},
+		},
+	})
+}
+
+func TestImageSyncImport(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(newFakeRegistry())
+	defer destReg.Close()
+
+	fakeImg, _ := random.Image(10, 1)
+	fakeImgDigest, _ := fakeImg.Digest()
+	initSrcImage(srcReg, "library/busybox:1.32", fakeImg)
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`resource "imagesync" "import_unit_test" {
+					source      = "%s/library/busybox:1.32"
+					destination = "%s/busybox:1.32"
+				}`, srcReg.URL[7:], destReg.URL[7:]),
+			},
+			{
+				// Resources are imported by their destination; nothing about the source can be known until the next plan
+				ResourceName:            "imagesync.import_unit_test",
+				ImportState:             true,
+				ImportStateId:           destReg.URL[7:] + "/busybox:1.32",
+				ImportStateVerify:       true,
+				ImportStateVerifyIgnore: []string{"source", "source_digest", "source_available", "converted_digest", "synced_digests"},
+			},
+			{
+				ResourceName:  "imagesync.import_unit_test",
+				ImportState:   true,
+				ImportStateId: fakeImgDigest.String(),
+				ExpectError:   regexp.MustCompile("resources with 'destinations' can't be imported"),
+			},
+		},
+	})
+}
+
+func TestImageSyncAdditionalTags(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(newFakeRegistry())
+	defer destReg.Close()
+
+	fakeImg, _ := random.Image(10, 1)
+	fakeImgDigest, _ := fakeImg.Digest()
+	initSrcImage(srcReg, "library/busybox:1.32", fakeImg)
+
+	stubConfig := func(tags string) string {
+		return fmt.Sprintf(`resource "imagesync" "tags_unit_test" {
+			source          = "%s/library/busybox:1.32"
+			destination     = "%s/busybox:1.32"
+			additional_tags = [%s]
+		}`, srcReg.URL[7:], destReg.URL[7:], tags)
+	}
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: stubConfig(`"1", "stable"`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.tags_unit_test", "additional_tags.#", "2"),
+					checkTagDigest(destReg.URL[7:]+"/busybox:1", fakeImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/busybox:stable", fakeImgDigest.String()),
+				),
+			},
+			{
+				// Tags are added and removed in place, leaving the primary destination untouched
+				Config: stubConfig(`"stable", "latest"`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.tags_unit_test", "id", destReg.URL[7:]+"/busybox@"+fakeImgDigest.String()),
+					resource.TestCheckResourceAttr("imagesync.tags_unit_test", "additional_tags.#", "2"),
+					checkTagDigest(destReg.URL[7:]+"/busybox:1.32", fakeImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/busybox:stable", fakeImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/busybox:latest", fakeImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/busybox:1", ""),
+				),
+			},
+			{
+				// Tags removed outside of Terraform are applied again
+				PreConfig: func() {
+					ref, _ := name.ParseReference(destReg.URL[7:]+"/busybox:latest", name.WeakValidation)
+					if err := remote.Delete(ref); err != nil {
+						t.Fatal(err)
+					}
+				},
+				Config: stubConfig(`"stable", "latest"`),
+				Check:  checkTagDigest(destReg.URL[7:]+"/busybox:latest", fakeImgDigest.String()),
+			},
+		},
+	})
+}
+
+// checkTagDigest checks the tag refers to the given digest, or doesn't exist at all if digest is empty
+func checkTagDigest(tag, digest string) resource.TestCheckFunc {
+	return func(*terraform.State) error {
+		ref, err := name.ParseReference(tag, name.WeakValidation)
+		if err != nil {
+			return err
+		}
+
+		desc, err := remote.Get(ref)
+		if digest == "" {
+			if err == nil {
+				return fmt.Errorf("expected tag %s to have been removed", tag)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if desc.Digest.String() != digest {
+			return fmt.Errorf("expected tag %s to refer to %s, got %s", tag, digest, desc.Digest)
+		}
+		return nil
+	}
+}
+
+func TestImageSyncReplaceStrategy(t *testing.T) {
+	for _, tc := range []struct {
+		strategy    string
+		wantDeletes bool
+	}{
+		{strategy: "overwrite", wantDeletes: false},
+		{strategy: "recreate", wantDeletes: true},
+	} {
+		t.Run(tc.strategy, func(t *testing.T) {
+			srcReg := httptest.NewServer(newFakeRegistry())
+			defer srcReg.Close()
+
+			var deletes int32
+			destReg := httptest.NewServer(countingHandler(&deletes, http.MethodDelete, "", newFakeRegistry()))
+			defer destReg.Close()
+
+			oldImg, _ := random.Image(10, 1)
+			newImg, _ := random.Image(10, 1)
+			newImgDigest, _ := newImg.Digest()
+			initSrcImage(srcReg, "library/busybox:latest", oldImg)
+
+			config := fmt.Sprintf(`resource "imagesync" "replace_unit_test" {
+				source           = "%s/library/busybox:latest"
+				destination      = "%s/busybox:latest"
+				replace_strategy = "%s"
+			}`, srcReg.URL[7:], destReg.URL[7:], tc.strategy)
+
+			resource.Test(t, resource.TestCase{
+				IsUnitTest: true,
+				Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+				Steps: []resource.TestStep{
+					{
+						Config: config,
+					},
+					{
+						// The upstream tag moves to a new image
+						PreConfig: func() { initSrcImage(srcReg, "library/busybox:latest", newImg) },
+						Config:    config,
+						Check: resource.ComposeTestCheckFunc(
+							resource.TestCheckResourceAttr("imagesync.replace_unit_test", "id", destReg.URL[7:]+"/busybox@"+newImgDigest.String()),
+							resource.TestCheckResourceAttr("imagesync.replace_unit_test", "source_digest", newImgDigest.String()),
+							func(*terraform.State) error {
+								// Overwriting in place never removes the destination tag, recreating does
+								if got := atomic.LoadInt32(&deletes) > 0; got != tc.wantDeletes {
+									return fmt.Errorf("expected deletes against the destination: %v, got %d", tc.wantDeletes, deletes)
+								}
+								return nil
+							},
+						),
+					},
+				},
+			})
+		})
+	}
+}
+
+func TestImageSyncDestinationDrift(t *testing.T) {
+	for _, tc := range []struct {
+		onDrift   string
+		wantError *regexp.Regexp
+		wantSync  bool
+	}{
+		{onDrift: "resync", wantSync: true},
+		{onDrift: "error", wantError: regexp.MustCompile("rather than .*, the image it was sync'd with")},
+		{onDrift: "ignore", wantSync: false},
+	} {
+		t.Run(tc.onDrift, func(t *testing.T) {
+			srcReg := httptest.NewServer(newFakeRegistry())
+			defer srcReg.Close()
+
+			// Listing tags lets unreferenced manifests be cleaned up, which must never include the other image
+			fr := newFakeRegistry()
+			fr.listTags = true
+			destReg := httptest.NewServer(fr)
+			defer destReg.Close()
+
+			fakeImg, _ := random.Image(10, 1)
+			fakeImgDigest, _ := fakeImg.Digest()
+			initSrcImage(srcReg, "library/busybox:1.32", fakeImg)
+
+			otherImg, _ := random.Image(10, 1)
+			otherImgDigest, _ := otherImg.Digest()
+
+			config := fmt.Sprintf(`resource "imagesync" "drift_unit_test" {
+				source               = "%s/library/busybox:1.32"
+				destination          = "%s/busybox:1.32"
+				on_destination_drift = "%s"
+			}`, srcReg.URL[7:], destReg.URL[7:], tc.onDrift)
+
+			wantDigest := otherImgDigest
+			if tc.wantSync {
+				wantDigest = fakeImgDigest
+			}
+
+			resource.Test(t, resource.TestCase{
+				IsUnitTest: true,
+				Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+				Steps: []resource.TestStep{
+					{
+						Config: config,
+						Check:  resource.TestCheckResourceAttr("imagesync.drift_unit_test", "destination_digest", fakeImgDigest.String()),
+					},
+					{
+						// Another image is pushed over the destination tag, outside of Terraform
+						PreConfig:   func() { initSrcImage(destReg, "busybox:1.32", otherImg) },
+						Config:      config,
+						ExpectError: tc.wantError,
+						Check: resource.ComposeTestCheckFunc(
+							resource.TestCheckResourceAttr("imagesync.drift_unit_test", "source_digest", fakeImgDigest.String()),
+							resource.TestCheckResourceAttr("imagesync.drift_unit_test", "destination_digest", wantDigest.String()),
+							checkTagDigest(destReg.URL[7:]+"/busybox:1.32", wantDigest.String()),
+							checkTagDigest(destReg.URL[7:]+"/busybox@"+otherImgDigest.String(), otherImgDigest.String()),
+						),
+					},
+				},
+			})
+		})
+	}
+}
+
+func TestImageSyncDestinationDriftWithSourceChange(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	// Listing tags lets unreferenced manifests be cleaned up, which must never include the other image
+	fr := newFakeRegistry()
+	fr.listTags = true
+	destReg := httptest.NewServer(fr)
+	defer destReg.Close()
+
+	oldImg, _ := random.Image(10, 1)
+	oldImgDigest, _ := oldImg.Digest()
+	initSrcImage(srcReg, "library/busybox:1", oldImg)
+
+	newImg, _ := random.Image(10, 1)
+	newImgDigest, _ := newImg.Digest()
+
+	otherImg, _ := random.Image(10, 1)
+	otherImgDigest, _ := otherImg.Digest()
+
+	config := fmt.Sprintf(`resource "imagesync" "drift_source_unit_test" {
+		source      = "%s/library/busybox:1"
+		destination = "%s/busybox:1"
+	}`, srcReg.URL[7:], destReg.URL[7:])
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check:  resource.TestCheckResourceAttr("imagesync.drift_source_unit_test", "synced_digests."+destReg.URL[7:]+"/busybox:1", oldImgDigest.String()),
+			},
+			{
+				// Another image is pushed over the destination tag outside of Terraform, as the upstream tag moves
+				PreConfig: func() {
+					initSrcImage(destReg, "busybox:1", otherImg)
+					initSrcImage(srcReg, "library/busybox:1", newImg)
+				},
+				Config: config,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.drift_source_unit_test", "synced_digests."+destReg.URL[7:]+"/busybox:1", newImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/busybox:1", newImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/busybox@"+otherImgDigest.String(), otherImgDigest.String()),
+				),
+			},
+		},
+	})
+}
+
+func TestImageSyncSourceMissing(t *testing.T) {
+	for _, tc := range []struct {
+		onMissing string
+		wantError *regexp.Regexp
+	}{
+		{onMissing: "fail", wantError: regexp.MustCompile("unable to locate source image")},
+		{onMissing: "keep"},
+		{onMissing: "warn"},
+	} {
+		t.Run(tc.onMissing, func(t *testing.T) {
+			srcReg := httptest.NewServer(newFakeRegistry())
+			defer srcReg.Close()
+
+			destReg := httptest.NewServer(newFakeRegistry())
+			defer destReg.Close()
+
+			fakeImg, _ := random.Image(10, 1)
+			fakeImgDigest, _ := fakeImg.Digest()
+			initSrcImage(srcReg, "vendor/app:1.0", fakeImg)
+
+			config := fmt.Sprintf(`resource "imagesync" "missing_unit_test" {
+				source            = "%s/vendor/app:1.0"
+				destination       = "%s/app:1.0"
+				on_source_missing = "%s"
+			}`, srcReg.URL[7:], destReg.URL[7:], tc.onMissing)
+
+			deleteSrc := func() {
+				ref, _ := name.ParseReference(srcReg.URL[7:]+"/vendor/app:1.0", name.WeakValidation)
+				if err := remote.Delete(ref); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			steps := []resource.TestStep{
+				{
+					Config: config,
+					Check:  resource.TestCheckResourceAttr("imagesync.missing_unit_test", "source_available", "true"),
+				},
+				{
+					// The upstream tag is deleted, but the destination still holds the image
+					PreConfig:   deleteSrc,
+					Config:      config,
+					ExpectError: tc.wantError,
+					Check: resource.ComposeTestCheckFunc(
+						resource.TestCheckResourceAttr("imagesync.missing_unit_test", "source_available", "false"),
+						resource.TestCheckResourceAttr("imagesync.missing_unit_test", "source_digest", fakeImgDigest.String()),
+						checkTagDigest(destReg.URL[7:]+"/app:1.0", fakeImgDigest.String()),
+					),
+				},
+			}
+			if tc.wantError == nil {
+				steps = append(steps,
+					resource.TestStep{
+						Config:   config,
+						PlanOnly: true,
+					},
+					resource.TestStep{
+						// The upstream tag reappears
+						PreConfig: func() { initSrcImage(srcReg, "vendor/app:1.0", fakeImg) },
+						Config:    config,
+						Check:     resource.TestCheckResourceAttr("imagesync.missing_unit_test", "source_available", "true"),
+					},
+				)
+			}
+
+			resource.Test(t, resource.TestCase{
+				IsUnitTest: true,
+				Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+				Steps:      steps,
+			})
+		})
+	}
+}
+
+func TestImageSyncPinnedSource(t *testing.T) {
+	var manifestGets int32
+	srcReg := httptest.NewServer(countingHandler(&manifestGets, http.MethodGet, "/manifests/", newFakeRegistry()))
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(newFakeRegistry())
+	defer destReg.Close()
+
+	fakeImg, _ := random.Image(10, 1)
+	fakeImgDigest, _ := fakeImg.Digest()
+	initSrcImage(srcReg, "library/busybox:1.32", fakeImg)
+
+	otherImg, _ := random.Image(10, 1)
+
+	stubConfig := func(verify bool) string {
+		return fmt.Sprintf(`resource "imagesync" "pinned_unit_test" {
+			source                = "%s/library/busybox@%s"
+			destination           = "%s/busybox:1.32"
+			verify_source_on_plan = %t
+		}`, srcReg.URL[7:], fakeImgDigest, destReg.URL[7:], verify)
+	}
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: stubConfig(false),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.pinned_unit_test", "source_digest", fakeImgDigest.String()),
+					resource.TestCheckResourceAttr("imagesync.pinned_unit_test", "destination_digest", fakeImgDigest.String()),
+					resource.TestCheckResourceAttr("imagesync.pinned_unit_test", "source_available", "true"),
+				),
+			},
+			{
+				// Planning never needs to contact the source registry
+				PreConfig: func() { atomic.StoreInt32(&manifestGets, 0) },
+				Config:    stubConfig(false),
+				PlanOnly:  true,
+			},
+			{
+				// Destinations are still checked for drift, and re-synced from the source if they have
+				PreConfig: func() {
+					if n := atomic.LoadInt32(&manifestGets); n != 0 {
+						t.Errorf("expected no manifests to be fetched from the source when planning, got %d", n)
+					}
+					initSrcImage(destReg, "busybox:1.32", otherImg)
+				},
+				Config: stubConfig(false),
+				Check:  checkTagDigest(destReg.URL[7:]+"/busybox:1.32", fakeImgDigest.String()),
+			},
+			{
+				// The source is removed upstream, which goes unnoticed until the source is verified
+				PreConfig: func() {
+					ref, _ := name.ParseReference(srcReg.URL[7:]+"/library/busybox@"+fakeImgDigest.String(), name.WeakValidation)
+					if err := remote.Delete(ref); err != nil {
+						t.Fatal(err)
+					}
+				},
+				Config:   stubConfig(false),
+				PlanOnly: true,
+			},
+			{
+				Config:      stubConfig(true),
+				ExpectError: regexp.MustCompile("unable to locate source image"),
+			},
+		},
+	})
+}
+
+func TestImageSyncPinnedSourcePlatforms(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(newFakeRegistry())
+	defer destReg.Close()
+
+	var adds []mutate.IndexAddendum
+	for _, p := range []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	} {
+		p := p
+		img, _ := random.Image(10, 1)
+		adds = append(adds, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &p}})
+	}
+	fakeIdx := mutate.AppendManifests(empty.Index, adds...)
+	fakeIdxDigest, _ := fakeIdx.Digest()
+	initSrcIndex(srcReg, "library/busybox:multiarch", fakeIdx)
+
+	wantIdx := mutate.AppendManifests(empty.Index, adds[:1]...)
+	wantIdxDigest, _ := wantIdx.Digest()
+
+	otherImg, _ := random.Image(10, 1)
+
+	stubConfig := func(onDrift string) string {
+		return fmt.Sprintf(`resource "imagesync" "pinned_platforms_unit_test" {
+			source               = "%s/library/busybox@%s"
+			destination          = "%s/busybox:multiarch"
+			platforms            = ["linux/amd64"]
+			on_destination_drift = "%s"
+		}`, srcReg.URL[7:], fakeIdxDigest, destReg.URL[7:], onDrift)
+	}
+	config := stubConfig("resync")
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				// The digest of the filtered index is recorded, rather than the digest the source is pinned to
+				Config: config,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.pinned_platforms_unit_test", "source_digest", wantIdxDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/busybox:multiarch", wantIdxDigest.String()),
+				),
+			},
+			{
+				Config:   config,
+				PlanOnly: true,
+			},
+			{
+				// Another image pushed over the destination is still detected, without the filtered index to hand
+				PreConfig:   func() { initSrcImage(destReg, "busybox:multiarch", otherImg) },
+				Config:      stubConfig("error"),
+				ExpectError: regexp.MustCompile("rather than " + wantIdxDigest.String() + ", the image it was sync'd with"),
+			},
+			{
+				Config: config,
+				Check:  checkTagDigest(destReg.URL[7:]+"/busybox:multiarch", wantIdxDigest.String()),
+			},
+		},
+	})
+}
+
+func TestImageSyncPullRateLimit(t *testing.T) {
+	srcLimit := newRateLimitedRegistry(2)
+	srcReg := httptest.NewServer(srcLimit)
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(newRateLimitedRegistry(0))
+	defer destReg.Close()
+
+	fakeImg, _ := random.Image(10, 1)
+	initSrcImage(srcReg, "library/busybox:latest", fakeImg)
+
+	newImg, _ := random.Image(10, 1)
+	newImgDigest, _ := newImg.Digest()
+
+	config := fmt.Sprintf(`resource "imagesync" "rate_limit_unit_test" {
+		source          = "%s/library/busybox:latest"
+		destination     = "%s/busybox:latest"
+		additional_tags = ["stable"]
+	}`, srcReg.URL[7:], destReg.URL[7:])
+
+	// Only syncing pulls manifests; planning and refreshing resolve every digest with HEAD requests alone
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+			},
+			{
+				Config:   config,
+				PlanOnly: true,
+			},
+			{
+				// The upstream tag moves, using up the last pull
+				PreConfig: func() { initSrcImage(srcReg, "library/busybox:latest", newImg) },
+				Config:    config,
+				Check:     resource.TestCheckResourceAttr("imagesync.rate_limit_unit_test", "source_digest", newImgDigest.String()),
+			},
+			{
+				Config:   config,
+				PlanOnly: true,
+			},
+		},
+	})
+}
+
+func TestImageSyncHeadFallback(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	// The destination registry doesn't describe manifests in response to HEAD requests
+	destLimit := newRateLimitedRegistry(-1)
+	destLimit.omitDigest = true
+	destReg := httptest.NewServer(destLimit)
+	defer destReg.Close()
+
+	fakeImg, _ := random.Image(10, 1)
+	fakeImgDigest, _ := fakeImg.Digest()
+	initSrcImage(srcReg, "library/busybox:latest", fakeImg)
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`resource "imagesync" "head_fallback_unit_test" {
+					source      = "%s/library/busybox:latest"
+					destination = "%s/busybox:latest"
+				}`, srcReg.URL[7:], destReg.URL[7:]),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.head_fallback_unit_test", "destination_digest", fakeImgDigest.String()),
+					func(*terraform.State) error {
+						if atomic.LoadInt32(&destLimit.pulls) == 0 {
+							return fmt.Errorf("expected manifests to be fetched when HEAD responses lack a digest")
+						}
+						return nil
+					},
+				),
+			},
+		},
+	})
+}
+
+// rateLimitedRegistry wraps the fake registry, rejecting manifest GETs beyond a limit as Docker Hub does, while
+// leaving HEAD requests unlimited
+type rateLimitedRegistry struct {
+	next  http.Handler
+	limit int32 // negative for unlimited pulls
+	pulls int32
+
+	// omitDigest strips the Docker-Content-Digest header from responses to HEAD requests
+	omitDigest bool
+}
+
+func newRateLimitedRegistry(limit int32) *rateLimitedRegistry {
+	return &rateLimitedRegistry{next: newFakeRegistry(), limit: limit}
+}
+
+func (rl *rateLimitedRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.URL.Path, "/manifests/") {
+		rl.next.ServeHTTP(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if n := atomic.AddInt32(&rl.pulls, 1); rl.limit >= 0 && n > rl.limit {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errors":[{"code":"TOOMANYREQUESTS","message":"You have reached your pull rate limit"}]}`))
+			return
+		}
+	case http.MethodHead:
+		if rl.omitDigest {
+			w = &omitHeaderWriter{ResponseWriter: w, header: "Docker-Content-Digest"}
+		}
+	}
+
+	rl.next.ServeHTTP(w, r)
+}
+
+type omitHeaderWriter struct {
+	http.ResponseWriter
+	header string
+}
+
+func (w *omitHeaderWriter) WriteHeader(statusCode int) {
+	w.Header().Del(w.header)
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func TestImageSyncOnDestroy(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		onDestroy        string
+		rejectTagDeletes bool
+		wantTagsRemoved  bool
+		wantManifestGone bool
+		wantDestroyError *regexp.Regexp
+	}{
+		{name: "delete_manifest", onDestroy: "delete_manifest", wantTagsRemoved: true, wantManifestGone: true},
+		{name: "delete_tag", onDestroy: "delete_tag", wantTagsRemoved: true},
+		{name: "retain", onDestroy: "retain"},
+		{
+			// The manifest is deleted by digest instead, taking its tags with it
+			name: "delete_manifest without tag deletes", onDestroy: "delete_manifest", rejectTagDeletes: true,
+			wantTagsRemoved: true, wantManifestGone: true,
+		},
+		{
+			name: "delete_tag without tag deletes", onDestroy: "delete_tag", rejectTagDeletes: true,
+			wantDestroyError: regexp.MustCompile("only deletes manifests by digest"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srcReg := httptest.NewServer(newFakeRegistry())
+			defer srcReg.Close()
+
+			fr := newFakeRegistry()
+			fr.listTags = true
+			fr.rejectTagDeletes = tc.rejectTagDeletes
+			destReg := httptest.NewServer(fr)
+			defer destReg.Close()
+
+			fakeImg, _ := random.Image(10, 1)
+			fakeImgDigest, _ := fakeImg.Digest()
+			initSrcImage(srcReg, "library/busybox:1.32", fakeImg)
+
+			stubConfig := func(onDestroy string) string {
+				return fmt.Sprintf(`resource "imagesync" "destroy_unit_test" {
+					source          = "%s/library/busybox:1.32"
+					destination     = "%s/busybox:1.32"
+					additional_tags = ["stable"]
+					on_destroy      = "%s"
+				}`, srcReg.URL[7:], destReg.URL[7:], onDestroy)
+			}
+
+			checkDestroyed := func(s *terraform.State) error {
+				if tc.wantDestroyError != nil {
+					return nil // Left in place by the final step
+				}
+
+				tagDigest := fakeImgDigest.String()
+				if tc.wantTagsRemoved {
+					tagDigest = ""
+				}
+				manifestDigest := fakeImgDigest.String()
+				if tc.wantManifestGone {
+					manifestDigest = ""
+				}
+
+				return resource.ComposeTestCheckFunc(
+					checkTagDigest(destReg.URL[7:]+"/busybox:1.32", tagDigest),
+					checkTagDigest(destReg.URL[7:]+"/busybox:stable", tagDigest),
+					checkTagDigest(destReg.URL[7:]+"/busybox@"+fakeImgDigest.String(), manifestDigest),
+				)(s)
+			}
+
+			steps := []resource.TestStep{
+				{
+					Config: stubConfig(tc.onDestroy),
+				},
+			}
+			if tc.wantDestroyError != nil {
+				steps = append(steps,
+					resource.TestStep{
+						Config:      stubConfig(tc.onDestroy),
+						Destroy:     true,
+						ExpectError: tc.wantDestroyError,
+					},
+					resource.TestStep{
+						// Retaining the image is the way out for registries that can't delete the tag alone
+						Config: stubConfig("retain"),
+						Check:  checkTagDigest(destReg.URL[7:]+"/busybox:1.32", fakeImgDigest.String()),
+					},
+				)
+			}
+
+			resource.Test(t, resource.TestCase{
+				IsUnitTest:   true,
+				Providers:    map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+				CheckDestroy: checkDestroyed,
+				Steps:        steps,
+			})
+		})
+	}
+}
+
+func TestImageSyncOnDestroyUpdates(t *testing.T) {
+	for _, tc := range []struct {
+		onDestroy        string
+		wantTagsRemoved  bool
+		wantManifestGone bool
+	}{
+		{onDestroy: "delete_manifest", wantTagsRemoved: true, wantManifestGone: true},
+		{onDestroy: "delete_tag", wantTagsRemoved: true},
+		{onDestroy: "retain"},
+	} {
+		t.Run(tc.onDestroy, func(t *testing.T) {
+			srcReg := httptest.NewServer(newFakeRegistry())
+			defer srcReg.Close()
+
+			fr := newFakeRegistry()
+			fr.listTags = true
+			destReg := httptest.NewServer(fr)
+			defer destReg.Close()
+
+			oldImg, _ := random.Image(10, 1)
+			oldImgDigest, _ := oldImg.Digest()
+			initSrcImage(srcReg, "library/busybox:latest", oldImg)
+
+			newImg, _ := random.Image(10, 1)
+			newImgDigest, _ := newImg.Digest()
+
+			stubConfig := func(dest string) string {
+				return fmt.Sprintf(`resource "imagesync" "destroy_updates_unit_test" {
+					source      = "%s/library/busybox:latest"
+					destination = "%s/%s"
+					on_destroy  = "%s"
+				}`, srcReg.URL[7:], destReg.URL[7:], dest, tc.onDestroy)
+			}
+
+			// want returns digest, unless on_destroy should have deleted it
+			want := func(digest v1.Hash, deleted bool) string {
+				if deleted {
+					return ""
+				}
+				return digest.String()
+			}
+
+			resource.Test(t, resource.TestCase{
+				IsUnitTest: true,
+				Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+				Steps: []resource.TestStep{
+					{
+						Config: stubConfig("busybox:1.32"),
+					},
+					{
+						// Overwriting the destination cleans up the old manifest, so long as on_destroy permits it
+						PreConfig: func() { initSrcImage(srcReg, "library/busybox:latest", newImg) },
+						Config:    stubConfig("busybox:1.32"),
+						Check:     checkTagDigest(destReg.URL[7:]+"/busybox@"+oldImgDigest.String(), want(oldImgDigest, tc.wantManifestGone)),
+					},
+					{
+						// Retagging removes the previous tag, so long as on_destroy permits it
+						Config: stubConfig("busybox:1.33"),
+						Check:  checkTagDigest(destReg.URL[7:]+"/busybox:1.32", want(newImgDigest, tc.wantTagsRemoved)),
+					},
+					{
+						// Moving to another repository deletes the previous tag, and the manifest with it only under
+						// delete_manifest
+						Config: stubConfig("mirror/busybox:1.33"),
+						Check: resource.ComposeTestCheckFunc(
+							checkTagDigest(destReg.URL[7:]+"/mirror/busybox:1.33", newImgDigest.String()),
+							checkTagDigest(destReg.URL[7:]+"/busybox:1.33", want(newImgDigest, tc.wantTagsRemoved)),
+							checkTagDigest(destReg.URL[7:]+"/busybox@"+newImgDigest.String(), want(newImgDigest, tc.wantManifestGone)),
+						),
+					},
+				},
+			})
+		})
+	}
+}
+
+// fakeRegistry wraps the fake registry, which can't delete manifests, with support for deleting them by tag or by
+// digest. Deleting a manifest by digest removes every tag referring to it, as real registries do
+type fakeRegistry struct {
+	next http.Handler
+
+	mu      sync.Mutex
+	tags    map[string]map[string]string // repository -> tag -> digest
+	deleted map[string]bool              // keyed by repository@digest
+
+	// listTags lists the tags within each repository, which the fake registry doesn't support
+	listTags bool
+	// rejectTagDeletes refuses to delete tags, as registries that only delete manifests by digest do
+	rejectTagDeletes bool
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{next: registry.New(), tags: map[string]map[string]string{}, deleted: map[string]bool{}}
+}
+
+func (fr *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if fr.listTags && strings.HasSuffix(r.URL.Path, "/tags/list") && r.Method == http.MethodGet {
+		repo := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"), "/tags/list")
+
+		fr.mu.Lock()
+		tags := []string{}
+		for tag := range fr.tags[repo] {
+			tags = append(tags, tag)
+		}
+		fr.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repo, "tags": tags})
+		return
+	}
+
+	at := strings.Index(r.URL.Path, "/manifests/")
+	if at == -1 {
+		fr.next.ServeHTTP(w, r)
+		return
+	}
+	repo, target := strings.TrimPrefix(r.URL.Path[:at], "/v2/"), r.URL.Path[at+len("/manifests/"):]
+	isDigest := strings.HasPrefix(target, "sha256:")
+
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h, _, _ := v1.SHA256(bytes.NewReader(body))
+
+		delete(fr.deleted, repo+"@"+h.String())
+		if !isDigest {
+			if fr.tags[repo] == nil {
+				fr.tags[repo] = map[string]string{}
+			}
+			fr.tags[repo][target] = h.String()
+		}
+	case http.MethodGet, http.MethodHead:
+		if !fr.exists(repo, target, isDigest) {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "Unknown manifest")
+			return
+		}
+	case http.MethodDelete:
+		if !fr.exists(repo, target, isDigest) {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "Unknown manifest")
+			return
+		}
+
+		if !isDigest {
+			if fr.rejectTagDeletes {
+				writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "The operation is unsupported.")
+				return
+			}
+			delete(fr.tags[repo], target)
+		} else {
+			fr.deleted[repo+"@"+target] = true
+			for tag, digest := range fr.tags[repo] {
+				if digest == target {
+					delete(fr.tags[repo], tag)
+				}
+			}
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	fr.next.ServeHTTP(w, r)
+}
+
+// exists reports whether the manifest has been pushed to repo under target, and not since been deleted
+func (fr *fakeRegistry) exists(repo, target string, isDigest bool) bool {
+	if !isDigest {
+		_, ok := fr.tags[repo][target]
+		return ok
+	}
+	if fr.deleted[repo+"@"+target] {
+		return false
+	}
+
+	rec := httptest.NewRecorder()
+	fr.next.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/v2/"+repo+"/manifests/"+target, nil))
+	return rec.Code == http.StatusOK
+}
+
+func writeRegistryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, message)
+}
+
+func TestImageSyncMountSameRegistry(t *testing.T) {
+	mr := newMountingRegistry()
+	reg := httptest.NewServer(mr)
+	defer reg.Close()
+
+	fakeIdx, _ := random.Index(10, 2, 2)
+	fakeIdxDigest, _ := fakeIdx.Digest()
+	initSrcIndex(reg, "staging/app:1.0", fakeIdx)
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`resource "imagesync" "mount_unit_test" {
+					source      = "%s/staging/app:1.0"
+					destination = "%s/prod/app:1.0"
+				}`, reg.URL[7:], reg.URL[7:]),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.mount_unit_test", "id", reg.URL[7:]+"/prod/app@"+fakeIdxDigest.String()),
+					func(*terraform.State) error {
+						// Every layer of both images is mounted, rather than pulled down and pushed back up
+						if n := atomic.LoadInt32(&mr.mounts); n != 4 {
+							return fmt.Errorf("expected 4 layers to be mounted, got %d", n)
+						}
+						if n := atomic.LoadInt32(&mr.layerPulls); n != 0 {
+							return fmt.Errorf("expected no layers to be pulled, got %d", n)
+						}
+						return nil
+					},
+					checkIndexChildrenExist(reg.URL[7:]+"/prod/app", fakeIdx),
+				),
+			},
+		},
+	})
+}
+
+// mountingRegistry wraps the fake registry, which shares every blob across every repository, so that blobs only
+// exist within the repositories they were pushed or mounted to. Cross-repository mounts are honoured, as they
+// would be by a real registry
+type mountingRegistry struct {
+	next http.Handler
+
+	mu    sync.Mutex
+	blobs map[string]bool // keyed by repo@digest
+	// configs holds the digest of every config blob, so that layers can be told apart from configs
+	configs map[string]bool
+
+	mounts     int32
+	layerPulls int32
+}
+
+func newMountingRegistry() *mountingRegistry {
+	return &mountingRegistry{next: newFakeRegistry(), blobs: map[string]bool{}, configs: map[string]bool{}}
+}
+
+func (mr *mountingRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i := strings.Index(r.URL.Path, "/blobs/")
+	if i == -1 {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+			mr.recordConfig(r)
+		}
+		mr.next.ServeHTTP(w, r)
+		return
+	}
+	repo, target := strings.TrimPrefix(r.URL.Path[:i], "/v2/"), r.URL.Path[i+len("/blobs/"):]
+
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Query().Get("mount") != "":
+		mount, from := r.URL.Query().Get("mount"), r.URL.Query().Get("from")
+		if mr.blobs[from+"@"+mount] {
+			mr.blobs[repo+"@"+mount] = true
+			atomic.AddInt32(&mr.mounts, 1)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+	case r.Method == http.MethodPut && r.URL.Query().Get("digest") != "":
+		mr.blobs[repo+"@"+r.URL.Query().Get("digest")] = true
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		if !mr.blobs[repo+"@"+target] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet && !mr.configs[target] {
+			atomic.AddInt32(&mr.layerPulls, 1)
+		}
+	}
+
+	mr.next.ServeHTTP(w, r)
+}
+
+func (mr *mountingRegistry) recordConfig(r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	var m struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(b, &m); err == nil && m.Config.Digest != "" {
+		mr.mu.Lock()
+		mr.configs[m.Config.Digest] = true
+		mr.mu.Unlock()
+	}
+}
+
+func TestImageSyncRetry(t *testing.T) {
+	srcReg := httptest.NewServer(newFakeRegistry())
+	defer srcReg.Close()
+
+	// The first blob upload fails partway through, and every blob committed to the registry is counted
+	var (
+		failed  int32
+		mu      sync.Mutex
+		commits = map[string]int{}
+	)
+	reg := newFakeRegistry()
+	destReg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			ioutil.ReadAll(io.LimitReader(r.Body, 10))
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if r.Method == http.MethodPut && r.URL.Query().Get("digest") != "" {
+			mu.Lock()
+			commits[r.URL.Query().Get("digest")]++
+			mu.Unlock()
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer destReg.Close()
+
+	fakeImg, _ := random.Image(1024, 3)
+	fakeImgDigest, _ := fakeImg.Digest()
+	initSrcImage(srcReg, "library/busybox:1.32", fakeImg)
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`provider "imagesync" {
+					retry {
+						min_backoff = "10ms"
+					}
+				}
+
+				resource "imagesync" "retry_unit_test" {
+					source      = "%s/library/busybox:1.32"
+					destination = "%s/busybox:1.32"
+				}`, srcReg.URL[7:], destReg.URL[7:]),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.retry_unit_test", "id", destReg.URL[7:]+"/busybox@"+fakeImgDigest.String()),
+					func(*terraform.State) error {
+						if atomic.LoadInt32(&failed) != 1 {
+							return fmt.Errorf("expected an upload to have failed")
+						}
+
+						// 3 layers and a config, each uploaded exactly once despite the failure
+						mu.Lock()
+						defer mu.Unlock()
+						if len(commits) != 4 {
+							return fmt.Errorf("expected 4 blobs to be committed, got %d", len(commits))
+						}
+						for digest, n := range commits {
+							if n != 1 {
+								return fmt.Errorf("expected %s to be uploaded once, got %d", digest, n)
+							}
+						}
+						return nil
+					},
+				),
+			},
+		},
+	})
+}
+
+func TestImageSyncMoveDestination(t *testing.T) {
+	// Every blob pulled from the source is counted, so we can check moves never go back to the source
+	var srcBlobPulls int32
+	srcReg := httptest.NewServer(countingHandler(&srcBlobPulls, http.MethodGet, "/blobs/", newFakeRegistry()))
+	defer srcReg.Close()
+
+	destReg := httptest.NewServer(newFakeRegistry())
+	defer destReg.Close()
+
+	fakeImg, _ := random.Image(10, 1)
+	fakeImgDigest, _ := fakeImg.Digest()
+	initSrcImage(srcReg, "library/busybox:1.32", fakeImg)
+
+	stubConfig := func(dest string) string {
+		return fmt.Sprintf(`resource "imagesync" "move_unit_test" {
+			source          = "%s/library/busybox:1.32"
+			destination     = "%s/%s"
+			additional_tags = ["stable"]
+		}`, srcReg.URL[7:], destReg.URL[7:], dest)
+	}
+
+	checkNoSourcePulls := func(*terraform.State) error {
+		if n := atomic.LoadInt32(&srcBlobPulls); n != 0 {
+			return fmt.Errorf("expected no blobs to be pulled from the source, got %d", n)
+		}
+		return nil
+	}
+
+	resource.Test(t, resource.TestCase{
+		IsUnitTest: true,
+		Providers:  map[string]terraform.ResourceProvider{"imagesync": imagesync.Provider()},
+		Steps: []resource.TestStep{
+			{
+				Config: stubConfig("busybox:1.32"),
+			},
+			{
+				// A tag-only change retags the existing image
+				PreConfig: func() { atomic.StoreInt32(&srcBlobPulls, 0) },
+				Config:    stubConfig("busybox:1.33"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.move_unit_test", "id", destReg.URL[7:]+"/busybox@"+fakeImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/busybox:1.33", fakeImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/busybox:stable", fakeImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/busybox:1.32", ""),
+					checkNoSourcePulls,
+				),
+			},
+			{
+				// A new repository within the same registry copies the image across from the previous repository
+				PreConfig: func() { atomic.StoreInt32(&srcBlobPulls, 0) },
+				Config:    stubConfig("mirror/busybox:1.33"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("imagesync.move_unit_test", "id", destReg.URL[7:]+"/mirror/busybox@"+fakeImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/mirror/busybox:1.33", fakeImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/mirror/busybox:stable", fakeImgDigest.String()),
+					checkTagDigest(destReg.URL[7:]+"/busybox:1.33", ""),
+					checkTagDigest(destReg.URL[7:]+"/busybox:stable", ""),
+					checkNoSourcePulls,
+				),
+			},
+		},
+	})
+}
+
+// countingHandler counts every request made with the given method, to a path containing pathContains
+func countingHandler(count *int32, method, pathContains string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == method && strings.Contains(r.URL.Path, pathContains) {
+			atomic.AddInt32(count, 1)
+		}
+		next.ServeHTTP(w, r)
+	})
 }
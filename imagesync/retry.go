@@ -0,0 +1,246 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// defaultRetryableStatusCodes are retried unless the provider's retry block says otherwise
+var defaultRetryableStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+const (
+	defaultRetryMaxAttempts = 5
+	defaultRetryMinBackoff  = time.Second
+	defaultRetryMaxBackoff  = 30 * time.Second
+)
+
+// retryPolicy describes how transient registry errors are retried, as described by retrySchema
+type retryPolicy struct {
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	statusCodes map[int]bool
+}
+
+// newRetryPolicy builds a policy from a set of retry settings, falling back to the defaults for any setting that
+// isn't set
+func newRetryPolicy(settings map[string]interface{}) (*retryPolicy, error) {
+	p := &retryPolicy{
+		maxAttempts: defaultRetryMaxAttempts,
+		minBackoff:  defaultRetryMinBackoff,
+		maxBackoff:  defaultRetryMaxBackoff,
+		statusCodes: map[int]bool{},
+	}
+
+	if v, _ := settings["max_attempts"].(int); v > 0 {
+		p.maxAttempts = v
+	}
+
+	durations := map[string]*time.Duration{
+		"min_backoff": &p.minBackoff,
+		"max_backoff": &p.maxBackoff,
+	}
+	for k, d := range durations {
+		if v, _ := settings[k].(string); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid '%s': %w", k, err)
+			}
+			*d = parsed
+		}
+	}
+	if p.maxBackoff < p.minBackoff {
+		return nil, errors.New("'max_backoff' must not be less than 'min_backoff'")
+	}
+
+	statusCodes := defaultRetryableStatusCodes
+	if raw, _ := settings["retryable_status_codes"].([]interface{}); len(raw) > 0 {
+		statusCodes = nil
+		for _, sc := range raw {
+			statusCodes = append(statusCodes, sc.(int))
+		}
+	}
+	for _, sc := range statusCodes {
+		p.statusCodes[sc] = true
+	}
+
+	return p, nil
+}
+
+// backoff returns how long to wait before the given retry (counting from 0). Exponential backoff applies, unless
+// the registry asked for a longer wait with a Retry-After header. No wait exceeds the max backoff
+func (p *retryPolicy) backoff(retry int, resp *http.Response) time.Duration {
+	wait := p.maxBackoff
+	if retry < 32 {
+		if exp := p.minBackoff << uint(retry); exp > 0 && exp < p.maxBackoff {
+			wait = exp
+		}
+	}
+
+	if retryAfter, ok := parseRetryAfter(resp); ok && retryAfter > wait {
+		wait = retryAfter
+	}
+	if wait > p.maxBackoff {
+		wait = p.maxBackoff
+	}
+
+	return wait
+}
+
+// retryable reports whether an operation which failed with err is worth attempting again
+func (p *retryPolicy) retryable(err error) bool {
+	var tErr *transport.Error
+	if errors.As(err, &tErr) {
+		return p.statusCodes[tErr.StatusCode]
+	}
+
+	// Hosts that don't exist won't start existing between attempts
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// do calls fn until it succeeds, fails with an error that isn't retryable, every attempt has been used up, or ctx
+// is done. retryTransport has already retried every request it could replay by the time fn fails, so fn is only
+// called again if a request it made with ctx (as returned by withUnreplayedRequests) couldn't be replayed; retrying
+// any other failure would multiply the attempts made
+func (p *retryPolicy) do(ctx context.Context, fn func() error) error {
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil || retry+1 >= p.maxAttempts || !p.retryable(err) || !unreplayedRequestFailed(ctx) || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(p.backoff(retry, nil)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// unreplayedKey is the context key under which retryTransport records a retryable failure of a request it couldn't
+// replay
+type unreplayedKey struct{}
+
+// withUnreplayedRequests returns a context in which retryTransport records any request it couldn't replay failing
+func withUnreplayedRequests(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unreplayedKey{}, new(int32))
+}
+
+// unreplayedRequestFailed reports whether a request made with ctx that retryTransport couldn't replay has failed
+// since last called
+func unreplayedRequestFailed(ctx context.Context) bool {
+	failed, ok := ctx.Value(unreplayedKey{}).(*int32)
+	return ok && atomic.SwapInt32(failed, 0) == 1
+}
+
+// parseRetryAfter reads the wait requested by a Retry-After header, given either in seconds or as an HTTP date
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(v); err == nil {
+		return time.Until(at), true
+	}
+
+	return 0, false
+}
+
+// retryTransport retries requests that fail with a network error or a retryable status code. Requests with bodies
+// that can't be replayed (i.e. blob uploads streamed from the source) are only ever attempted once; their failures
+// are recorded for whatever is writing the image to retry
+type retryTransport struct {
+	next   http.RoundTripper
+	policy *retryPolicy
+}
+
+func newRetryTransport(rt http.RoundTripper, policy *retryPolicy) http.RoundTripper {
+	if policy == nil || policy.maxAttempts <= 1 {
+		return rt
+	}
+
+	return &retryTransport{next: rt, policy: policy}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		resp, err := t.next.RoundTrip(req)
+		if failed, ok := req.Context().Value(unreplayedKey{}).(*int32); ok && t.shouldRetry(req, resp, err) {
+			atomic.StoreInt32(failed, 1)
+		}
+		return resp, err
+	}
+
+	for retry := 0; ; retry++ {
+		r := req
+		if retry > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(r)
+		if retry+1 >= t.policy.maxAttempts || !t.shouldRetry(req, resp, err) {
+			return resp, err
+		}
+
+		wait := t.policy.backoff(retry, resp)
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func (t *retryTransport) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		return t.policy.retryable(err)
+	}
+
+	return t.policy.statusCodes[resp.StatusCode]
+}
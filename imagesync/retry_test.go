@@ -0,0 +1,208 @@
+package imagesync
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestRetryTransport(t *testing.T) {
+	for desc, tc := range map[string]struct {
+		settings     map[string]interface{}
+		failures     int
+		status       int
+		retryAfter   string
+		request      func(url string) *http.Request
+		wantRequests int32
+		wantStatus   int
+		wantMinWait  time.Duration
+	}{
+		"retryable status eventually succeeds": {
+			failures:     2,
+			status:       http.StatusBadGateway,
+			wantRequests: 3,
+			wantStatus:   http.StatusOK,
+		},
+		"attempts exhausted": {
+			settings:     map[string]interface{}{"max_attempts": 2},
+			failures:     5,
+			status:       http.StatusServiceUnavailable,
+			wantRequests: 2,
+			wantStatus:   http.StatusServiceUnavailable,
+		},
+		"status not retryable": {
+			failures:     1,
+			status:       http.StatusNotFound,
+			wantRequests: 1,
+			wantStatus:   http.StatusNotFound,
+		},
+		"custom retryable status codes": {
+			settings:     map[string]interface{}{"retryable_status_codes": []interface{}{http.StatusNotFound}},
+			failures:     1,
+			status:       http.StatusNotFound,
+			wantRequests: 2,
+			wantStatus:   http.StatusOK,
+		},
+		"retry after honoured": {
+			failures:     1,
+			status:       http.StatusTooManyRequests,
+			retryAfter:   "1",
+			wantRequests: 2,
+			wantStatus:   http.StatusOK,
+			wantMinWait:  time.Second,
+		},
+		"streamed bodies are never retried": {
+			failures: 1,
+			status:   http.StatusBadGateway,
+			request: func(url string) *http.Request {
+				req, _ := http.NewRequest(http.MethodPatch, url+"/v2/busybox/blobs/uploads/123", ioutil.NopCloser(strings.NewReader("layer")))
+				return req
+			},
+			wantRequests: 1,
+			wantStatus:   http.StatusBadGateway,
+		},
+		"replayable bodies are retried": {
+			failures: 1,
+			status:   http.StatusBadGateway,
+			request: func(url string) *http.Request {
+				req, _ := http.NewRequest(http.MethodPut, url+"/v2/busybox/manifests/latest", strings.NewReader("manifest"))
+				return req
+			},
+			wantRequests: 2,
+			wantStatus:   http.StatusOK,
+		},
+	} {
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if b, _ := ioutil.ReadAll(r.Body); r.Method != http.MethodGet && len(b) == 0 {
+				w.WriteHeader(http.StatusBadRequest) // Bodies must be replayed in full on every attempt
+				return
+			}
+
+			if n := atomic.AddInt32(&requests, 1); int(n) <= tc.failures {
+				if tc.retryAfter != "" {
+					w.Header().Set("Retry-After", tc.retryAfter)
+				}
+				w.WriteHeader(tc.status)
+			}
+		}))
+
+		settings := map[string]interface{}{"min_backoff": "1ms", "max_backoff": "5s"}
+		for k, v := range tc.settings {
+			settings[k] = v
+		}
+		policy, err := newRetryPolicy(settings)
+		if err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v2/", nil)
+		if tc.request != nil {
+			req = tc.request(srv.URL)
+		}
+
+		start := time.Now()
+		resp, err := newRetryTransport(http.DefaultTransport, policy).RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		resp.Body.Close()
+		srv.Close()
+
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", desc, tc.wantStatus, resp.StatusCode)
+		}
+		if requests != tc.wantRequests {
+			t.Errorf("%s: expected %d requests, got %d", desc, tc.wantRequests, requests)
+		}
+		if elapsed := time.Since(start); elapsed < tc.wantMinWait {
+			t.Errorf("%s: expected to wait at least %v, waited %v", desc, tc.wantMinWait, elapsed)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	for desc, tc := range map[string]struct {
+		request      func(url string) *http.Request
+		wantRequests int32
+		wantCalls    int
+	}{
+		"replayed requests are only retried by the transport": {
+			request: func(url string) *http.Request {
+				req, _ := http.NewRequest(http.MethodPut, url+"/v2/busybox/manifests/latest", strings.NewReader("manifest"))
+				return req
+			},
+			wantRequests: 3,
+			wantCalls:    1,
+		},
+		"streamed bodies are retried by calling again": {
+			request: func(url string) *http.Request {
+				req, _ := http.NewRequest(http.MethodPatch, url+"/v2/busybox/blobs/uploads/123", ioutil.NopCloser(strings.NewReader("layer")))
+				return req
+			},
+			wantRequests: 3,
+			wantCalls:    3,
+		},
+	} {
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+
+		policy, err := newRetryPolicy(map[string]interface{}{"max_attempts": 3, "min_backoff": "1ms"})
+		if err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		client := http.Client{Transport: newRetryTransport(http.DefaultTransport, policy)}
+
+		calls := 0
+		ctx := withUnreplayedRequests(context.Background())
+		err = policy.do(ctx, func() error {
+			calls++
+			resp, err := client.Do(tc.request(srv.URL).WithContext(ctx))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			return transport.CheckError(resp, http.StatusOK)
+		})
+		srv.Close()
+
+		if err == nil {
+			t.Errorf("%s: expected every attempt to fail", desc)
+		}
+		if requests != tc.wantRequests {
+			t.Errorf("%s: expected %d requests, got %d", desc, tc.wantRequests, requests)
+		}
+		if calls != tc.wantCalls {
+			t.Errorf("%s: expected %d calls, got %d", desc, tc.wantCalls, calls)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy, err := newRetryPolicy(map[string]interface{}{"min_backoff": "1s", "max_backoff": "10s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for retry, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second} {
+		if got := policy.backoff(retry, nil); got != want {
+			t.Errorf("retry %d: expected backoff of %v, got %v", retry, want, got)
+		}
+	}
+
+	// Retry-After can extend the backoff, up to the max backoff
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"60"}}}
+	if got := policy.backoff(0, resp); got != 10*time.Second {
+		t.Errorf("expected Retry-After to be capped at the max backoff, got %v", got)
+	}
+}
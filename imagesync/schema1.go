@@ -0,0 +1,129 @@
+package imagesync
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// schema1Manifest is a Docker image manifest, version 2 schema 1. Layers and history are both ordered from the
+// most recent layer to the base layer
+type schema1Manifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Architecture  string `json:"architecture"`
+	FSLayers      []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// schema1Compatibility holds the parts of a v1Compatibility history entry needed to describe its layer. The
+// entry for the most recent layer also holds the config of the image as a whole
+type schema1Compatibility struct {
+	Created         v1.Time `json:"created"`
+	Author          string  `json:"author"`
+	Comment         string  `json:"comment"`
+	ThrowAway       bool    `json:"throwaway"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+}
+
+func isSchema1(mt types.MediaType) bool {
+	return mt == types.DockerManifestSchema1 || mt == types.DockerManifestSchema1Signed
+}
+
+// convertSchema1 converts the schema1 manifest held by desc into a schema2 image, synthesizing its config from the
+// v1Compatibility history in the same way docker does when pulling a schema1 image. Every layer is read in full to
+// compute its diff ID. The layers themselves are left in place in desc's repository, so they can be mounted when
+// written to the same registry. Conversion is deterministic; converting the same manifest always results in the
+// same image
+func convertSchema1(desc *remote.Descriptor, options ...remote.Option) (v1.Image, error) {
+	var m schema1Manifest
+	if err := json.Unmarshal(desc.Manifest, &m); err != nil {
+		return nil, fmt.Errorf("unable to parse schema1 manifest: %w", err)
+	}
+
+	if m.SchemaVersion != 1 {
+		return nil, fmt.Errorf("unexpected schemaVersion %d for schema1 manifest", m.SchemaVersion)
+	}
+	if len(m.FSLayers) == 0 || len(m.FSLayers) != len(m.History) {
+		return nil, fmt.Errorf("schema1 manifest has %d layers but %d history entries", len(m.FSLayers), len(m.History))
+	}
+
+	repo := desc.Ref.Context()
+
+	var (
+		adds    []mutate.Addendum
+		history []v1.History
+	)
+	for i := len(m.FSLayers) - 1; i >= 0; i-- {
+		var compat schema1Compatibility
+		if err := json.Unmarshal([]byte(m.History[i].V1Compatibility), &compat); err != nil {
+			return nil, fmt.Errorf("unable to parse v1Compatibility of history entry %d: %w", i, err)
+		}
+
+		history = append(history, v1.History{
+			Created:    compat.Created,
+			Author:     compat.Author,
+			CreatedBy:  strings.Join(compat.ContainerConfig.Cmd, " "),
+			Comment:    compat.Comment,
+			EmptyLayer: compat.ThrowAway,
+		})
+
+		// Throwaway layers only exist to carry history; they aren't part of the image's filesystem
+		if compat.ThrowAway {
+			continue
+		}
+
+		layer, err := schema1Layer(repo, m.FSLayers[i].BlobSum, options...)
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, mutate.Addendum{Layer: layer})
+	}
+
+	img, err := mutate.Append(empty.Image, adds...)
+	if err != nil {
+		return nil, err
+	}
+
+	layered, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	// The most recent history entry describes the image as a whole; anything not specific to that one layer
+	// becomes the config of the converted image
+	var cfg v1.ConfigFile
+	if err := json.Unmarshal([]byte(m.History[0].V1Compatibility), &cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse image config from schema1 history: %w", err)
+	}
+	if cfg.Architecture == "" {
+		cfg.Architecture = m.Architecture
+	}
+	if cfg.OS == "" {
+		cfg.OS = "linux"
+	}
+	cfg.RootFS = layered.RootFS
+	cfg.History = history
+
+	return mutate.ConfigFile(img, &cfg)
+}
+
+func schema1Layer(repo name.Repository, blobSum string, options ...remote.Option) (v1.Layer, error) {
+	if _, err := v1.NewHash(blobSum); err != nil {
+		return nil, fmt.Errorf("invalid blobSum '%s' in schema1 manifest: %w", blobSum, err)
+	}
+
+	return remote.Layer(repo.Digest(blobSum), options...)
+}
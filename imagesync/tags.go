@@ -0,0 +1,75 @@
+package imagesync
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// tagPattern matches valid tags, as per the distribution spec
+var tagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+
+func validateTag(v interface{}, k string) ([]string, []error) {
+	if !tagPattern.MatchString(v.(string)) {
+		return nil, []error{fmt.Errorf("'%s' is not a valid tag", v.(string))}
+	}
+	return nil, nil
+}
+
+// sortedStrings returns the contents of a set of strings in a stable order
+func sortedStrings(s *schema.Set) []string {
+	var strs []string
+	for _, raw := range s.List() {
+		strs = append(strs, raw.(string))
+	}
+	sort.Strings(strs)
+
+	return strs
+}
+
+// tagDestination applies each tag to the manifest t within the repository of dest. Only the manifest is written;
+// every blob it references must already exist within the repository
+func tagDestination(c *config, dest string, t remote.Taggable, tags []string, auth authn.Authenticator) error {
+	destRef, err := c.parseReference(dest)
+	if err != nil {
+		return err
+	}
+
+	destOpts, err := c.remoteOptions(destRef, auth)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if err := remote.Tag(destRef.Context().Tag(tag), t, destOpts...); err != nil {
+			return fmt.Errorf("unable to apply tag '%s': %w", tag, err)
+		}
+	}
+
+	return nil
+}
+
+// untagDestination removes each tag from the repository of dest. Tags that no longer exist are ignored
+func untagDestination(c *config, dest string, tags []string, auth authn.Authenticator) error {
+	destRef, err := c.parseReference(dest)
+	if err != nil {
+		return err
+	}
+
+	destOpts, err := c.remoteOptions(destRef, auth)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if err := remote.Delete(destRef.Context().Tag(tag), destOpts...); err != nil && !isNotFound(err) {
+			return fmt.Errorf("unable to remove tag '%s': %w", tag, err)
+		}
+	}
+
+	return nil
+}
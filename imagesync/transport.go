@@ -0,0 +1,131 @@
+package imagesync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// newBaseTransport builds the transport every registry connection is derived from, as described by httpSchema.
+// Unset settings retain the values of http.DefaultTransport, including honouring the proxy environment variables
+func newBaseTransport(settings map[string]interface{}) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if settings == nil {
+		return t, nil
+	}
+
+	if proxyURL, _ := settings["proxy_url"].(string); proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'proxy_url': %w", err)
+		}
+
+		username, _ := settings["proxy_username"].(string)
+		password, _ := settings["proxy_password"].(string)
+		if username != "" {
+			u.User = url.UserPassword(username, password)
+		}
+
+		var noProxy []string
+		rawNoProxy, _ := settings["no_proxy"].([]interface{})
+		for _, np := range rawNoProxy {
+			noProxy = append(noProxy, np.(string))
+		}
+
+		proxyFunc := (&httpproxy.Config{
+			HTTPProxy:  u.String(),
+			HTTPSProxy: u.String(),
+			NoProxy:    strings.Join(noProxy, ","),
+		}).ProxyFunc()
+
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second} // as per http.DefaultTransport
+	durations := map[string]*time.Duration{
+		"dial_timeout":            &dialer.Timeout,
+		"tls_handshake_timeout":   &t.TLSHandshakeTimeout,
+		"response_header_timeout": &t.ResponseHeaderTimeout,
+		"idle_conn_timeout":       &t.IdleConnTimeout,
+	}
+	for k, d := range durations {
+		if v, _ := settings[k].(string); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid '%s': %w", k, err)
+			}
+			*d = parsed
+		}
+	}
+	t.DialContext = dialer.DialContext
+
+	if v, _ := settings["max_idle_conns"].(int); v > 0 {
+		t.MaxIdleConns = v
+	}
+	if v, _ := settings["max_idle_conns_per_host"].(int); v > 0 {
+		t.MaxIdleConnsPerHost = v
+	}
+	if v, _ := settings["max_conns_per_host"].(int); v > 0 {
+		t.MaxConnsPerHost = v
+	}
+
+	return t, nil
+}
+
+// registryConnection describes how to reach a registry; whether TLS can be skipped entirely, and the transport
+// carrying every request made against it
+type registryConnection struct {
+	insecureHTTP bool
+	transport    http.RoundTripper
+}
+
+// newRegistryConnection builds a connection from a set of connectivity settings, as described by
+// connectionSchema, on top of the given base transport
+func newRegistryConnection(base *http.Transport, settings map[string]interface{}) (*registryConnection, error) {
+	skipTLSVerify, _ := settings["skip_tls_verify"].(bool)
+	caBundlePEM, _ := settings["ca_bundle_pem"].(string)
+	clientCertPEM, _ := settings["client_cert_pem"].(string)
+	clientKeyPEM, _ := settings["client_key_pem"].(string)
+	insecureHTTP, _ := settings["insecure_http"].(bool)
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: skipTLSVerify,
+	}
+
+	if caBundlePEM != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(caBundlePEM)) {
+			return nil, errors.New("'ca_bundle_pem' contains no valid PEM encoded certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	switch {
+	case clientCertPEM != "" && clientKeyPEM != "":
+		cert, err := tls.X509KeyPair([]byte(clientCertPEM), []byte(clientKeyPEM))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case clientCertPEM != "" || clientKeyPEM != "":
+		return nil, errors.New("'client_cert_pem' and 'client_key_pem' must be specified together")
+	}
+
+	t := base.Clone()
+	t.TLSClientConfig = tlsConfig
+
+	return &registryConnection{insecureHTTP: insecureHTTP, transport: t}, nil
+}
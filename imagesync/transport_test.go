@@ -0,0 +1,185 @@
+package imagesync
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRegistryConnectionTLS(t *testing.T) {
+	clientCertPEM, clientKeyPEM, clientCert := selfSignedCert(t)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caBundlePEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	for desc, tc := range map[string]struct {
+		settings map[string]interface{}
+		ok       bool
+	}{
+		"private CA not trusted": {
+			settings: map[string]interface{}{"client_cert_pem": clientCertPEM, "client_key_pem": clientKeyPEM},
+		},
+		"no client certificate": {
+			settings: map[string]interface{}{"ca_bundle_pem": caBundlePEM},
+		},
+		"private CA and client certificate": {
+			settings: map[string]interface{}{"ca_bundle_pem": caBundlePEM, "client_cert_pem": clientCertPEM, "client_key_pem": clientKeyPEM},
+			ok:       true,
+		},
+		"skip verification with client certificate": {
+			settings: map[string]interface{}{"skip_tls_verify": true, "client_cert_pem": clientCertPEM, "client_key_pem": clientKeyPEM},
+			ok:       true,
+		},
+	} {
+		conn, err := newRegistryConnection(http.DefaultTransport.(*http.Transport), tc.settings)
+		if err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+
+		client := http.Client{Transport: conn.transport}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%s: expected success to be %t, got error: %v", desc, tc.ok, err)
+		}
+	}
+
+	if _, err := newRegistryConnection(http.DefaultTransport.(*http.Transport), map[string]interface{}{"client_cert_pem": clientCertPEM}); err == nil {
+		t.Error("expected a client certificate without a key to be rejected")
+	}
+	if _, err := newRegistryConnection(http.DefaultTransport.(*http.Transport), map[string]interface{}{"ca_bundle_pem": "not a certificate"}); err == nil {
+		t.Error("expected an invalid CA bundle to be rejected")
+	}
+}
+
+func TestParseReferenceInsecureHTTP(t *testing.T) {
+	insecure, _ := newRegistryConnection(http.DefaultTransport.(*http.Transport), map[string]interface{}{"insecure_http": true})
+	secure, _ := newRegistryConnection(http.DefaultTransport.(*http.Transport), map[string]interface{}{})
+
+	c := &config{
+		defaultConnection:   secure,
+		registryConnections: map[string]*registryConnection{"registry.internal:5000": insecure},
+	}
+
+	for ref, scheme := range map[string]string{
+		"registry.internal:5000/busybox:1.32": "http",
+		"registry.example.com/busybox:1.32":   "https",
+	} {
+		r, err := c.parseReference(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Context().Registry.Scheme(); got != scheme {
+			t.Errorf("expected '%s' to use %s, got %s", ref, scheme, got)
+		}
+	}
+}
+
+func selfSignedCert(t *testing.T) (certPEM, keyPEM string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "imagesync"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	return certPEM, keyPEM, cert
+}
+
+func TestBaseTransportProxy(t *testing.T) {
+	base, err := newBaseTransport(map[string]interface{}{
+		"proxy_url":      "http://proxy.corp:3128",
+		"proxy_username": "svc-terraform",
+		"proxy_password": "p@ss",
+		"no_proxy":       []interface{}{"registry.internal", ".corp.example.com"},
+		"dial_timeout":   "5s",
+		"max_idle_conns": 7,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if base.MaxIdleConns != 7 {
+		t.Errorf("expected max idle connections to be 7, got %d", base.MaxIdleConns)
+	}
+
+	// Registry connections derive their transports from the base transport, so must inherit the proxy
+	conn, err := newRegistryConnection(base, map[string]interface{}{"skip_tls_verify": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, proxied := range map[string]bool{
+		"registry.hub.docker.com":    true,
+		"registry.internal":          false,
+		"harbor.corp.example.com":    false,
+		"registry.internal.evil.com": true,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+host+"/v2/", nil)
+		proxyURL, err := conn.transport.(*http.Transport).Proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !proxied {
+			if proxyURL != nil {
+				t.Errorf("expected '%s' to bypass the proxy, got %s", host, proxyURL)
+			}
+			continue
+		}
+
+		if proxyURL == nil || proxyURL.Host != "proxy.corp:3128" {
+			t.Errorf("expected '%s' to be proxied, got %v", host, proxyURL)
+			continue
+		}
+		if pw, _ := proxyURL.User.Password(); proxyURL.User.Username() != "svc-terraform" || pw != "p@ss" {
+			t.Errorf("expected proxy credentials for '%s', got %s", host, proxyURL.User)
+		}
+	}
+
+	if _, err := newBaseTransport(map[string]interface{}{"dial_timeout": "soon"}); err == nil {
+		t.Error("expected an invalid duration to be rejected")
+	}
+}
@@ -0,0 +1,109 @@
+package imagesync
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadAbortTimeout bounds how long is spent cancelling each abandoned upload session
+const uploadAbortTimeout = 10 * time.Second
+
+// uploadSessions tracks blob upload sessions that have been started but not yet completed, so they can be cancelled
+// at the registry should the upload be abandoned. Sessions are grouped by the context of the requests that started
+// them, so that only the sessions belonging to a single write are ever cancelled together
+type uploadSessions struct {
+	mu       sync.Mutex
+	sessions map[context.Context]map[string]uploadSession // keyed by the path of the session's upload location
+}
+
+type uploadSession struct {
+	location string
+	header   http.Header // carries the credentials the session was started with
+	rt       http.RoundTripper
+}
+
+func newUploadSessions() *uploadSessions {
+	return &uploadSessions{sessions: map[context.Context]map[string]uploadSession{}}
+}
+
+// transport wraps rt, recording every upload session started through it
+func (u *uploadSessions) transport(rt http.RoundTripper) http.RoundTripper {
+	return &uploadTrackingTransport{next: rt, sessions: u}
+}
+
+// abort cancels every upload session still in progress that was started with ctx. Sessions are cancelled on a best
+// effort basis; registries will expire any that can't be cancelled eventually
+func (u *uploadSessions) abort(ctx context.Context) {
+	u.mu.Lock()
+	sessions := u.sessions[ctx]
+	delete(u.sessions, ctx)
+	u.mu.Unlock()
+
+	for _, s := range sessions {
+		abortCtx, cancel := context.WithTimeout(context.Background(), uploadAbortTimeout)
+
+		req, err := http.NewRequestWithContext(abortCtx, http.MethodDelete, s.location, nil)
+		if err == nil {
+			req.Header = s.header
+			if resp, err := s.rt.RoundTrip(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+
+		cancel()
+	}
+}
+
+func (u *uploadSessions) started(ctx context.Context, path string, s uploadSession) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.sessions[ctx] == nil {
+		u.sessions[ctx] = map[string]uploadSession{}
+	}
+	u.sessions[ctx][path] = s
+}
+
+func (u *uploadSessions) finished(ctx context.Context, path string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delete(u.sessions[ctx], path)
+	if len(u.sessions[ctx]) == 0 {
+		delete(u.sessions, ctx)
+	}
+}
+
+type uploadTrackingTransport struct {
+	next     http.RoundTripper
+	sessions *uploadSessions
+}
+
+func (t *uploadTrackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !strings.Contains(req.URL.Path, "/blobs/uploads/") {
+		return resp, err
+	}
+
+	ctx := req.Context()
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		// Starting or continuing a session; either way the registry tells us where the session continues from
+		loc, err := req.URL.Parse(resp.Header.Get("Location"))
+		if err != nil || resp.Header.Get("Location") == "" {
+			break
+		}
+
+		if req.Method != http.MethodPost {
+			t.sessions.finished(ctx, req.URL.Path)
+		}
+		t.sessions.started(ctx, loc.Path, uploadSession{location: loc.String(), header: req.Header.Clone(), rt: t.next})
+	case req.Method == http.MethodPut && resp.StatusCode == http.StatusCreated:
+		t.sessions.finished(ctx, req.URL.Path)
+	}
+
+	return resp, err
+}
@@ -0,0 +1,69 @@
+package imagesync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUploadSessionsAbort(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			w.Header().Set("Location", "/v2/busybox/blobs/uploads/"+r.URL.Query().Get("session"))
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			if r.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("expected %s to be aborted with the credentials it was started with", r.URL.Path)
+			}
+
+			mu.Lock()
+			deleted = append(deleted, r.URL.Path)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	sessions := newUploadSessions()
+	client := http.Client{Transport: sessions.transport(http.DefaultTransport)}
+
+	do := func(ctx context.Context, method, path string) {
+		req, _ := http.NewRequestWithContext(ctx, method, srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	write, cancelWrite := context.WithCancel(context.Background())
+	defer cancelWrite()
+	other, cancelOther := context.WithCancel(context.Background())
+	defer cancelOther()
+
+	do(write, http.MethodPost, "/v2/busybox/blobs/uploads/?session=abandoned")
+	do(write, http.MethodPost, "/v2/busybox/blobs/uploads/?session=completed")
+	do(write, http.MethodPut, "/v2/busybox/blobs/uploads/completed?digest=sha256:abc")
+	do(other, http.MethodPost, "/v2/busybox/blobs/uploads/?session=other")
+
+	sessions.abort(write)
+
+	if len(deleted) != 1 || !strings.HasSuffix(deleted[0], "/abandoned") {
+		t.Fatalf("expected only the abandoned session to be aborted, got %v", deleted)
+	}
+
+	// Aborting is only ever done once per session
+	sessions.abort(write)
+	if len(deleted) != 1 {
+		t.Fatalf("expected no further sessions to be aborted, got %v", deleted)
+	}
+}